@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"eventbus"
+)
+
+// Действия в истории приёма, кроме переноса
+const (
+	historyCancelled = "cancelled"
+	historyStatus    = "status"
+)
+
+const roleDoctor = "doctor"
+
+var (
+	errCancelTooLate     = errors.New("срок отмены записи прошёл, обратитесь в клинику")
+	errNotBooked         = errors.New("запись уже отменена или состоялась")
+	errBadTransition     = errors.New("недопустимая смена статуса")
+	errBookingRestricted = errors.New("запись в клинику ограничена из-за неявок")
+)
+
+// worksAt — сотрудник клиники: её администратор, врач или администратор системы
+func (u *caller) worksAt(clinicID int) bool {
+	if u.managesClinic(clinicID) {
+		return true
+	}
+	return u.Role == roleDoctor && u.ClinicID != nil && *u.ClinicID == clinicID
+}
+
+// statusTransitions — какие статусы сотрудник может выставить из какого.
+// Неявку можно исправить, если пациент всё-таки пришёл.
+var statusTransitions = map[string][]string{
+	statusBooked:     {statusInProgress, statusCompleted, statusNoShow},
+	statusInProgress: {statusCompleted},
+	statusNoShow:     {statusInProgress, statusCompleted},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// lockedAppointment — запись, заблокированная для изменения, с правилами её клиники
+type lockedAppointment struct {
+	ID                      int
+	UserID                  int
+	SlotID                  int
+	Status                  string
+	Start                   time.Time
+	ClinicID                int
+	CancellationCutoff      time.Duration
+	LateCancellationAllowed bool
+}
+
+func lockAppointment(ctx context.Context, tx *sql.Tx, id int) (*lockedAppointment, error) {
+	a := lockedAppointment{ID: id}
+	var cutoffHours int
+	err := tx.QueryRowContext(ctx, `
+		SELECT a.user_id, a.slot_id, a.status, s.start_time, COALESCE(d.clinic_id, 0),
+		       COALESCE(cl.cancellation_cutoff_hours, 0), COALESCE(cl.late_cancellation_allowed, true)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		LEFT JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE a.id = $1
+		FOR UPDATE OF a`, id).
+		Scan(&a.UserID, &a.SlotID, &a.Status, &a.Start, &a.ClinicID, &cutoffHours, &a.LateCancellationAllowed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errAppointmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.CancellationCutoff = time.Duration(cutoffHours) * time.Hour
+	return &a, nil
+}
+
+// cancelAppointment отменяет запись от имени u. Пациент отменяет только свою
+// запись; позже срока клиники — только если клиника это разрешает, и такая
+// отмена отмечается как поздняя. Сотрудники клиники отменяют без ограничений.
+func cancelAppointment(ctx context.Context, db *sql.DB, u *caller, id int, reason string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	a, err := lockAppointment(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	staff := u.worksAt(a.ClinicID)
+	if !staff && u.ID != a.UserID {
+		return errForbidden
+	}
+	if a.Status != statusBooked {
+		return errNotBooked
+	}
+	late := !staff && time.Until(a.Start) < a.CancellationCutoff
+	if late && !a.LateCancellationAllowed {
+		return errCancelTooLate
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE appointments
+		SET status = $2, cancelled_at = NOW(), cancelled_by = $3, cancel_reason = NULLIF($4, ''), cancelled_late = $5
+		WHERE id = $1`, id, statusCancelled, u.ID, reason, late); err != nil {
+		return err
+	}
+	if err := addHistory(ctx, tx, id, historyCancelled, &u.ID, reason); err != nil {
+		return err
+	}
+	if err := offerSlot(ctx, tx, a.SlotID, waitlistHold()); err != nil {
+		return err
+	}
+	if err := publishAppointment(ctx, tx, eventbus.AppointmentCancelled, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setStatus отмечает приход, завершение или неявку. Только сотрудники клиники.
+func setStatus(ctx context.Context, db *sql.DB, u *caller, id int, status string) (*Appointment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a, err := lockAppointment(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !u.worksAt(a.ClinicID) {
+		return nil, errForbidden
+	}
+	if !canTransition(a.Status, status) {
+		return nil, errBadTransition
+	}
+
+	res := Appointment{ID: id, UserID: a.UserID, SlotID: a.SlotID, Status: status}
+	if err := tx.QueryRowContext(ctx, `
+		UPDATE appointments SET status = $2 WHERE id = $1 RETURNING created_at`, id, status).Scan(&res.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := addHistory(ctx, tx, id, historyStatus, &u.ID, a.Status+" → "+status); err != nil {
+		return nil, err
+	}
+	if topic := statusTopic(status); topic != "" {
+		if err := publishAppointment(ctx, tx, topic, id); err != nil {
+			return nil, err
+		}
+	}
+	return &res, tx.Commit()
+}
+
+// statusTopic — событие о смене статуса, если оно кому-то интересно
+func statusTopic(status string) string {
+	switch status {
+	case statusCompleted:
+		return eventbus.AppointmentCompleted
+	case statusNoShow:
+		return eventbus.AppointmentNoShow
+	}
+	return ""
+}
+
+func addHistory(ctx context.Context, tx *sql.Tx, id int, action string, changedBy *int, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO appointment_history (appointment_id, action, changed_by, reason)
+		VALUES ($1, $2, $3, NULLIF($4, ''))`, id, action, changedBy, reason)
+	return err
+}
+
+// markNoShows отмечает неявками записи, приём по которым закончился больше
+// чем grace назад, а пациента так и не отметили пришедшим
+func markNoShows(ctx context.Context, db *sql.DB, grace time.Duration) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		WITH due AS (
+			SELECT a.id FROM appointments a
+			JOIN schedule_slots s ON s.id = a.slot_id
+			WHERE a.status = $1
+			  AND COALESCE(s.end_time, s.start_time) < NOW() - make_interval(secs => $3)
+			ORDER BY a.id
+			LIMIT 200
+			FOR UPDATE OF a SKIP LOCKED
+		)
+		UPDATE appointments a SET status = $2
+		FROM due WHERE a.id = due.id
+		RETURNING a.id`, statusBooked, statusNoShow, grace.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := addHistory(ctx, tx, id, historyStatus, nil, statusBooked+" → "+statusNoShow+" (автоматически)"); err != nil {
+			return 0, err
+		}
+		if err := publishAppointment(ctx, tx, eventbus.AppointmentNoShow, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), tx.Commit()
+}
+
+// runNoShowSweeper раз в every отмечает неявки; NO_SHOW_GRACE_MINUTES —
+// сколько после конца приёма ждать отметки о приходе
+func runNoShowSweeper(db *sql.DB, every time.Duration) {
+	grace := time.Hour
+	if m, err := strconv.Atoi(os.Getenv("NO_SHOW_GRACE_MINUTES")); err == nil && m >= 0 {
+		grace = time.Duration(m) * time.Minute
+	}
+	for {
+		for {
+			n, err := markNoShows(context.Background(), db, grace)
+			if err != nil {
+				log.Printf("неявки: %v", err)
+			}
+			if n == 0 || err != nil {
+				break
+			}
+		}
+		time.Sleep(every)
+	}
+}
+
+// Attendance — неявки и поздние отмены пациента в клинике за окно её правил
+type Attendance struct {
+	ClinicID          int  `json:"clinic_id"`
+	NoShows           int  `json:"no_shows"`
+	LateCancellations int  `json:"late_cancellations"`
+	WindowDays        int  `json:"window_days"`
+	NoShowLimit       *int `json:"no_show_limit"`
+	// BookingRestricted — новые записи в клинику пациенту закрыты
+	BookingRestricted bool `json:"booking_restricted"`
+}
+
+// patientAttendance считает неявки и поздние отмены пациента по клиникам
+func patientAttendance(db *sql.DB, patientID int) ([]Attendance, error) {
+	rows, err := db.Query(`
+		SELECT cl.id, cl.no_show_window_days, cl.no_show_limit,
+		       COUNT(*) FILTER (WHERE a.status = $2),
+		       COUNT(*) FILTER (WHERE a.status = $3 AND a.cancelled_late)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE a.user_id = $1
+		  AND s.start_time >= NOW() - make_interval(days => cl.no_show_window_days)
+		GROUP BY cl.id
+		ORDER BY cl.id`, patientID, statusNoShow, statusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Attendance{}
+	for rows.Next() {
+		var at Attendance
+		if err := rows.Scan(&at.ClinicID, &at.WindowDays, &at.NoShowLimit, &at.NoShows, &at.LateCancellations); err != nil {
+			return nil, err
+		}
+		at.BookingRestricted = at.NoShowLimit != nil && at.NoShows >= *at.NoShowLimit
+		list = append(list, at)
+	}
+	return list, rows.Err()
+}
+
+// queryRower — *sql.DB или *sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// checkBookingAllowed возвращает errBookingRestricted, если у пациента
+// в клинике врача doctorID набралось no_show_limit неявок
+func checkBookingAllowed(ctx context.Context, q queryRower, patientID, doctorID int) error {
+	var restricted bool
+	err := q.QueryRowContext(ctx, `
+		SELECT cl.no_show_limit IS NOT NULL AND cl.no_show_limit <= (
+			SELECT COUNT(*) FROM appointments a
+			JOIN schedule_slots s ON s.id = a.slot_id
+			JOIN doctors d2 ON d2.id = s.doctor_id
+			WHERE a.user_id = $1 AND a.status = $3 AND d2.clinic_id = cl.id
+			  AND s.start_time >= NOW() - make_interval(days => cl.no_show_window_days))
+		FROM doctors d
+		JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE d.id = $2`, patientID, doctorID, statusNoShow).Scan(&restricted)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Врач без клиники — правил нет
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if restricted {
+		return errBookingRestricted
+	}
+	return nil
+}
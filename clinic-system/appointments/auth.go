@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Роли пользователей из таблицы users
+const (
+	rolePatient     = "patient"
+	roleClinicAdmin = "clinic_admin"
+	roleAdmin       = "admin"
+)
+
+// caller — пользователь, от имени которого пришёл запрос (X-User-ID gateway берёт из JWT)
+type caller struct {
+	ID       int
+	Role     string
+	ClinicID *int
+}
+
+// requireCaller — id пользователя из X-User-ID (gateway берёт его из JWT).
+// При ошибке сам отвечает клиенту.
+func requireCaller(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "нужен заголовок X-User-ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// requireUser — requireCaller с ролью и клиникой пользователя
+func requireUser(db *sql.DB, c *gin.Context) (*caller, bool) {
+	id, ok := requireCaller(c)
+	if !ok {
+		return nil, false
+	}
+	u := caller{ID: id}
+	var role sql.NullString
+	err := db.QueryRow(`SELECT role, clinic_id FROM users WHERE id = $1`, id).Scan(&role, &u.ClinicID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "пользователь не найден"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+		return nil, false
+	}
+	u.Role = role.String
+	return &u, true
+}
+
+// managesClinic — администратор этой клиники или администратор системы
+func (u *caller) managesClinic(clinicID int) bool {
+	if u.Role == roleAdmin {
+		return true
+	}
+	return u.Role == roleClinicAdmin && u.ClinicID != nil && *u.ClinicID == clinicID
+}
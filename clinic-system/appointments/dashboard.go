@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"time"
+)
+
+// Состояния слота в дневном расписании клиники
+const (
+	slotFree      = "free"
+	slotHeld      = "held"    // придержан для листа ожидания
+	slotBooked    = "booked"  // пациент записан, но ещё не отмечен
+	slotBlocked   = "blocked" // закрыт без записи
+	slotCheckedIn = "checked_in"
+	slotCompleted = "completed"
+	slotNoShow    = "no_show"
+)
+
+// slotStates — состояние слота по статусу записи на него
+var slotStates = map[string]string{
+	statusBooked:     slotBooked,
+	statusInProgress: slotCheckedIn,
+	statusCompleted:  slotCompleted,
+	statusNoShow:     slotNoShow,
+}
+
+// DaySlot — слот врача на день с записью, если она есть
+type DaySlot struct {
+	SlotID        int        `json:"slot_id"`
+	Start         time.Time  `json:"start"`
+	End           *time.Time `json:"end"`
+	State         string     `json:"state"`
+	AppointmentID *int       `json:"appointment_id,omitempty"`
+	Status        string     `json:"status,omitempty"`
+	PatientID     *int       `json:"patient_id,omitempty"`
+	PatientName   string     `json:"patient_name,omitempty"`
+}
+
+// DayStats — загрузка: занятые слоты (записан, пришёл, завершён, не явился)
+// от всех слотов дня и пришедшие от занятых
+type DayStats struct {
+	TotalSlots  int     `json:"total_slots"`
+	BookedSlots int     `json:"booked_slots"`
+	Attended    int     `json:"attended"`
+	NoShows     int     `json:"no_shows"`
+	Utilisation float64 `json:"utilisation_percent"`
+	Attendance  float64 `json:"attendance_percent"`
+}
+
+func (s *DayStats) add(state string) {
+	s.TotalSlots++
+	switch state {
+	case slotBooked:
+		s.BookedSlots++
+	case slotCheckedIn, slotCompleted:
+		s.BookedSlots++
+		s.Attended++
+	case slotNoShow:
+		s.BookedSlots++
+		s.NoShows++
+	}
+}
+
+func (s *DayStats) finish() {
+	s.Utilisation = percent(s.BookedSlots, s.TotalSlots)
+	s.Attendance = percent(s.Attended, s.BookedSlots)
+}
+
+// percent — доля в процентах с одним знаком после запятой
+func percent(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(part)*1000/float64(total)) / 10
+}
+
+// DayDoctor — расписание врача на день
+type DayDoctor struct {
+	ID        int       `json:"id"`
+	FullName  string    `json:"full_name"`
+	Specialty string    `json:"specialty"`
+	Slots     []DaySlot `json:"slots"`
+	DayStats
+}
+
+// DayView — день клиники: все врачи со слотами и загрузкой
+type DayView struct {
+	ClinicID int         `json:"clinic_id"`
+	Date     string      `json:"date"`
+	Doctors  []DayDoctor `json:"doctors"`
+	Totals   DayStats    `json:"totals"`
+}
+
+// clinicDay собирает день клиники одним запросом: врачи клиники, их слоты
+// на дату, действующая запись на каждый слот с именем пациента и бронь
+// листа ожидания. Врачи без слотов тоже попадают в ответ.
+func clinicDay(db *sql.DB, clinicID int, date time.Time) (*DayView, error) {
+	day := date.Format(dateLayout)
+	rows, err := db.Query(`
+		SELECT d.id, COALESCE(d.full_name, ''), COALESCE(d.specialty, ''),
+		       s.id, s.start_time, s.end_time, COALESCE(s.is_available, false),
+		       a.id, a.status, a.user_id, COALESCE(u.full_name, ''),
+		       h.id IS NOT NULL
+		FROM doctors d
+		LEFT JOIN schedule_slots s
+		       ON s.doctor_id = d.id AND s.start_time >= $2::DATE AND s.start_time < $2::DATE + 1
+		LEFT JOIN LATERAL (
+			SELECT id, status, user_id FROM appointments
+			WHERE slot_id = s.id AND status <> $3
+			ORDER BY id DESC
+			LIMIT 1
+		) a ON true
+		LEFT JOIN users u ON u.id = a.user_id
+		LEFT JOIN slot_holds h ON h.slot_id = s.id AND h.status = $4
+		WHERE d.clinic_id = $1
+		ORDER BY d.full_name, d.id, s.start_time, s.id`, clinicID, day, statusCancelled, holdActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	view := DayView{ClinicID: clinicID, Date: day, Doctors: []DayDoctor{}}
+	var cur *DayDoctor
+	for rows.Next() {
+		var doctorID int
+		var name, specialty string
+		var slotID, appointmentID, patientID sql.NullInt64
+		var start sql.NullTime
+		var end *time.Time
+		var available, held bool
+		var status sql.NullString
+		var patientName string
+		if err := rows.Scan(&doctorID, &name, &specialty, &slotID, &start, &end, &available,
+			&appointmentID, &status, &patientID, &patientName, &held); err != nil {
+			return nil, err
+		}
+		if cur == nil || cur.ID != doctorID {
+			view.Doctors = append(view.Doctors, DayDoctor{ID: doctorID, FullName: name, Specialty: specialty, Slots: []DaySlot{}})
+			cur = &view.Doctors[len(view.Doctors)-1]
+		}
+		if !slotID.Valid {
+			continue
+		}
+
+		s := DaySlot{SlotID: int(slotID.Int64), Start: start.Time, End: end}
+		switch {
+		case appointmentID.Valid:
+			id, pid := int(appointmentID.Int64), int(patientID.Int64)
+			s.AppointmentID, s.Status, s.PatientID, s.PatientName = &id, status.String, &pid, patientName
+			s.State = slotStates[status.String]
+			if s.State == "" {
+				s.State = slotBooked
+			}
+		case held:
+			s.State = slotHeld
+		case available:
+			s.State = slotFree
+		default:
+			s.State = slotBlocked
+		}
+		cur.Slots = append(cur.Slots, s)
+		cur.add(s.State)
+		view.Totals.add(s.State)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range view.Doctors {
+		view.Doctors[i].finish()
+	}
+	view.Totals.finish()
+	return &view, nil
+}
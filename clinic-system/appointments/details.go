@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// DoctorRef — врач приёма
+type DoctorRef struct {
+	ID        int    `json:"id"`
+	FullName  string `json:"full_name"`
+	Specialty string `json:"specialty"`
+}
+
+// ClinicRef — клиника врача
+type ClinicRef struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	City    string `json:"city"`
+	Address string `json:"address"`
+	Phone   string `json:"phone"`
+}
+
+// PaymentRef — действующая оплата приёма; сумма в минорных единицах валюты
+type PaymentRef struct {
+	ID          int    `json:"id"`
+	Status      string `json:"status"`
+	AmountMinor int64  `json:"amount_minor"`
+	Currency    string `json:"currency"`
+}
+
+// RecordRef — медкарта по приёму; содержимое отдаёт сервис medical_records
+type RecordRef struct {
+	ID        int        `json:"id"`
+	VisitDate *time.Time `json:"visit_date"`
+}
+
+// Cancellation — кто, когда и почему отменил запись
+type Cancellation struct {
+	At     time.Time `json:"at"`
+	By     *int      `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	Late   bool      `json:"late"`
+}
+
+// AppointmentDetails — запись со всем, что нужно для экрана приёма
+type AppointmentDetails struct {
+	Appointment
+	PatientName   string        `json:"patient_name"`
+	Start         time.Time     `json:"start"`
+	End           *time.Time    `json:"end"`
+	Doctor        DoctorRef     `json:"doctor"`
+	Clinic        *ClinicRef    `json:"clinic"`
+	Payment       *PaymentRef   `json:"payment"`
+	MedicalRecord *RecordRef    `json:"medical_record"`
+	Cancellation  *Cancellation `json:"cancellation,omitempty"`
+}
+
+// loadDetails собирает запись одним запросом. Оплата — последняя
+// непроваленная, а если таких нет — последняя попытка.
+func loadDetails(db *sql.DB, id int) (*AppointmentDetails, error) {
+	var d AppointmentDetails
+	var clinicID, paymentID, recordID sql.NullInt64
+	var clinicName, clinicCity, clinicAddress, clinicPhone, paymentStatus, currency sql.NullString
+	var amount sql.NullInt64
+	var visitDate, cancelledAt sql.NullTime
+	var cancelledBy sql.NullInt64
+	var cancelReason sql.NullString
+	var cancelledLate bool
+	err := db.QueryRow(`
+		SELECT a.id, a.user_id, a.slot_id, a.status, a.created_at, COALESCE(u.full_name, ''),
+		       s.start_time, s.end_time,
+		       d.id, COALESCE(d.full_name, ''), COALESCE(d.specialty, ''),
+		       cl.id, cl.name, cl.city, cl.address, cl.phone,
+		       p.id, p.payment_status, p.amount_minor, p.currency,
+		       mr.id, mr.visit_date,
+		       a.cancelled_at, a.cancelled_by, a.cancel_reason, a.cancelled_late
+		FROM appointments a
+		JOIN users u ON u.id = a.user_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		LEFT JOIN clinics cl ON cl.id = d.clinic_id
+		LEFT JOIN LATERAL (
+			SELECT id, payment_status, amount_minor, currency FROM payments
+			WHERE appointment_id = a.id
+			ORDER BY payment_status = 'failed', id DESC
+			LIMIT 1
+		) p ON true
+		LEFT JOIN medical_records mr ON mr.appointment_id = a.id
+		WHERE a.id = $1`, id).
+		Scan(&d.ID, &d.UserID, &d.SlotID, &d.Status, &d.CreatedAt, &d.PatientName,
+			&d.Start, &d.End,
+			&d.Doctor.ID, &d.Doctor.FullName, &d.Doctor.Specialty,
+			&clinicID, &clinicName, &clinicCity, &clinicAddress, &clinicPhone,
+			&paymentID, &paymentStatus, &amount, &currency,
+			&recordID, &visitDate,
+			&cancelledAt, &cancelledBy, &cancelReason, &cancelledLate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errAppointmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if clinicID.Valid {
+		d.Clinic = &ClinicRef{ID: int(clinicID.Int64), Name: clinicName.String, City: clinicCity.String,
+			Address: clinicAddress.String, Phone: clinicPhone.String}
+	}
+	if paymentID.Valid {
+		d.Payment = &PaymentRef{ID: int(paymentID.Int64), Status: paymentStatus.String,
+			AmountMinor: amount.Int64, Currency: currency.String}
+	}
+	if recordID.Valid {
+		d.MedicalRecord = &RecordRef{ID: int(recordID.Int64)}
+		if visitDate.Valid {
+			d.MedicalRecord.VisitDate = &visitDate.Time
+		}
+	}
+	if cancelledAt.Valid {
+		d.Cancellation = &Cancellation{At: cancelledAt.Time, Reason: cancelReason.String, Late: cancelledLate}
+		if cancelledBy.Valid {
+			by := int(cancelledBy.Int64)
+			d.Cancellation.By = &by
+		}
+	}
+	return &d, nil
+}
+
+// clinicID — клиника записи, 0 если врач к клинике не привязан
+func (d *AppointmentDetails) clinicID() int {
+	if d.Clinic == nil {
+		return 0
+	}
+	return d.Clinic.ID
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"eventbus"
+)
+
+// appointmentEvent собирает полезную нагрузку события о приёме
+func appointmentEvent(ctx context.Context, tx *sql.Tx, id int) (eventbus.Appointment, error) {
+	ev := eventbus.Appointment{AppointmentID: id}
+	err := tx.QueryRowContext(ctx, `
+		SELECT a.user_id, a.slot_id, d.id, COALESCE(d.clinic_id, 0), s.start_time,
+		       a.cancelled_by, COALESCE(a.cancel_reason, '')
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE a.id = $1`, id).
+		Scan(&ev.PatientID, &ev.SlotID, &ev.DoctorID, &ev.ClinicID, &ev.Start, &ev.CancelledBy, &ev.Reason)
+	return ev, err
+}
+
+// publishAppointment публикует событие о приёме в транзакции tx
+func publishAppointment(ctx context.Context, tx *sql.Tx, topic string, id int) error {
+	ev, err := appointmentEvent(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	return eventbus.Publish(ctx, tx, topic, ev)
+}
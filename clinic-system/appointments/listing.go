@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Выборка по времени приёма
+const (
+	whenUpcoming = "upcoming" // ещё не начались, ближайшие первыми
+	whenPast     = "past"     // уже начались, последние первыми
+)
+
+var knownStatuses = []string{statusBooked, statusInProgress, statusCompleted, statusCancelled, statusNoShow}
+
+// appointmentFilter — параметры выборки GET /appointments
+type appointmentFilter struct {
+	PatientID int
+	When      string
+	Statuses  []string
+	From      *time.Time // включительно
+	To        *time.Time // не включительно
+	Limit     int
+	After     *listCursor
+}
+
+// listCursor — последняя запись предыдущей страницы
+type listCursor struct {
+	Start time.Time
+	ID    int
+}
+
+func (c listCursor) encode() string {
+	raw := c.Start.Format(time.RFC3339Nano) + "," + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	errCursor := fmt.Errorf("неверный cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errCursor
+	}
+	start, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return nil, errCursor
+	}
+	var c listCursor
+	if c.Start, err = time.Parse(time.RFC3339Nano, start); err != nil {
+		return nil, errCursor
+	}
+	if c.ID, err = strconv.Atoi(id); err != nil {
+		return nil, errCursor
+	}
+	return &c, nil
+}
+
+// parseAppointmentFilter разбирает ?when=upcoming|past&status=&from=&to=&limit=&cursor=
+func parseAppointmentFilter(c *gin.Context, patientID int) (*appointmentFilter, error) {
+	f := appointmentFilter{PatientID: patientID, Limit: 20}
+
+	switch f.When = c.Query("when"); f.When {
+	case "", whenUpcoming, whenPast:
+	default:
+		return nil, fmt.Errorf("when: upcoming или past")
+	}
+	if s := c.Query("status"); s != "" {
+		for _, st := range strings.Split(s, ",") {
+			if st = strings.TrimSpace(st); st == "" {
+				continue
+			}
+			if !slices.Contains(knownStatuses, st) {
+				return nil, fmt.Errorf("неизвестный статус %q", st)
+			}
+			f.Statuses = append(f.Statuses, st)
+		}
+	}
+	var err error
+	if f.From, f.To, err = parseDateRange(c); err != nil {
+		return nil, err
+	}
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("limit должен быть от 1 до 100")
+		}
+		f.Limit = n
+	}
+	if s := c.Query("cursor"); s != "" {
+		if f.After, err = decodeCursor(s); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+// parseDateRange разбирает ?from=&to= в формате ГГГГ-ММ-ДД. Обе даты
+// включительно, поэтому to сдвигается на сутки вперёд.
+func parseDateRange(c *gin.Context) (from, to *time.Time, err error) {
+	if s := c.Query("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from должен быть в формате ГГГГ-ММ-ДД")
+		}
+		from = &t
+	}
+	if s := c.Query("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("to должен быть в формате ГГГГ-ММ-ДД")
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+	return from, to, nil
+}
+
+// ListedAppointment — запись в списке пациента вместе со временем слота
+type ListedAppointment struct {
+	Appointment
+	DoctorID int        `json:"doctor_id"`
+	Start    time.Time  `json:"start"`
+	End      *time.Time `json:"end"`
+}
+
+// queryAppointments возвращает страницу записей, упорядоченных по времени
+// слота (при равном времени — по id), и курсор следующей страницы или nil
+func queryAppointments(db *sql.DB, f *appointmentFilter) ([]ListedAppointment, *listCursor, error) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"a.user_id = " + arg(f.PatientID)}
+	order, cmp := "ASC", ">"
+	switch f.When {
+	case whenUpcoming:
+		where = append(where, "s.start_time >= NOW()")
+	case whenPast:
+		where = append(where, "s.start_time < NOW()")
+		order, cmp = "DESC", "<"
+	}
+	if len(f.Statuses) > 0 {
+		where = append(where, "a.status = ANY("+arg(pq.Array(f.Statuses))+")")
+	}
+	if f.From != nil {
+		where = append(where, "s.start_time >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "s.start_time < "+arg(*f.To))
+	}
+	if f.After != nil {
+		// Время без зоны, как в start_time: иначе сравнение зависело бы от TimeZone сессии
+		after := f.After.Start.Format("2006-01-02 15:04:05.999999")
+		where = append(where, fmt.Sprintf("(s.start_time, a.id) %s (%s::TIMESTAMP, %s)", cmp, arg(after), arg(f.After.ID)))
+	}
+
+	// Берём на одну строку больше, чтобы узнать, есть ли следующая страница
+	rows, err := db.Query(`
+		SELECT a.id, a.user_id, a.slot_id, a.status, a.created_at, s.doctor_id, s.start_time, s.end_time
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY s.start_time `+order+`, a.id `+order+`
+		LIMIT `+arg(f.Limit+1), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	list := []ListedAppointment{}
+	for rows.Next() {
+		var a ListedAppointment
+		if err := rows.Scan(&a.ID, &a.UserID, &a.SlotID, &a.Status, &a.CreatedAt, &a.DoctorID, &a.Start, &a.End); err != nil {
+			return nil, nil, err
+		}
+		list = append(list, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(list) <= f.Limit {
+		return list, nil, nil
+	}
+	list = list[:f.Limit]
+	last := list[len(list)-1]
+	return list, &listCursor{Start: last.Start, ID: last.ID}, nil
+}
@@ -2,13 +2,26 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"eventbus"
+
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+)
+
+// Статусы записи на приём
+const (
+	statusBooked     = "записан"
+	statusInProgress = "на приёме"
+	statusCompleted  = "завершён"
+	statusCancelled  = "отменён"
+	statusNoShow     = "не явился"
 )
 
 type Appointment struct {
@@ -31,18 +44,85 @@ func main() {
 	}
 	defer db.Close()
 
+	waitlistEvery := 30 * time.Second
+	if sec, err := strconv.Atoi(os.Getenv("WAITLIST_SWEEP_SECONDS")); err == nil && sec > 0 {
+		waitlistEvery = time.Duration(sec) * time.Second
+	}
+	go runWaitlistSweeper(db, waitlistEvery)
+
+	noShowEvery := 5 * time.Minute
+	if sec, err := strconv.Atoi(os.Getenv("NO_SHOW_SWEEP_SECONDS")); err == nil && sec > 0 {
+		noShowEvery = time.Duration(sec) * time.Second
+	}
+	go runNoShowSweeper(db, noShowEvery)
+
 	r := gin.Default()
 
-	// Записаться на приём
+	// Записаться на приём. Пациент записывает себя (X-User-ID); сотрудник
+	// клиники врача может записать другого пациента, указав user_id.
 	r.POST("/appointments", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
 		var a Appointment
 		if err := c.BindJSON(&a); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
 			return
 		}
-		a.Status = "записан"
+		if a.UserID == 0 {
+			a.UserID = u.ID
+		}
+		a.Status = statusBooked
+
+		tx, err := db.BeginTx(c.Request.Context(), nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+			return
+		}
+		defer tx.Rollback()
+
+		// Слот, придержанный для листа ожидания, тоже занят
+		var available bool
+		var doctorID, clinicID int
+		err = tx.QueryRow(`
+			SELECT COALESCE(s.is_available, false), s.doctor_id, COALESCE(d.clinic_id, 0)
+			FROM schedule_slots s
+			JOIN doctors d ON d.id = s.doctor_id
+			WHERE s.id = $1
+			FOR UPDATE OF s`, a.SlotID).
+			Scan(&available, &doctorID, &clinicID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "слот не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+			return
+		}
+		if a.UserID != u.ID && !u.worksAt(clinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "записать другого пациента может только сотрудник клиники"})
+			return
+		}
+		if !available {
+			c.JSON(http.StatusConflict, gin.H{"error": "слот уже занят"})
+			return
+		}
+		err = checkBookingAllowed(c.Request.Context(), tx, a.UserID, doctorID)
+		if errors.Is(err, errBookingRestricted) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+			return
+		}
+		if _, err := tx.Exec(`UPDATE schedule_slots SET is_available = false WHERE id = $1`, a.SlotID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+			return
+		}
 
-		err := db.QueryRow(`
+		err = tx.QueryRow(`
 			INSERT INTO appointments (user_id, slot_id, status)
 			VALUES ($1, $2, $3) RETURNING id, created_at`,
 			a.UserID, a.SlotID, a.Status).Scan(&a.ID, &a.CreatedAt)
@@ -50,50 +130,456 @@ func main() {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
 			return
 		}
+		if err := publishAppointment(c.Request.Context(), tx, eventbus.AppointmentBooked, a.ID); err != nil {
+			log.Printf("событие о записи %d: %v", a.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+			return
+		}
 
 		c.JSON(http.StatusCreated, a)
 	})
 
-	// Получить список записей по user_id (через заголовок)
+	// Записи пациента (X-User-ID) по времени приёма:
+	// ?when=upcoming|past&status=записан,завершён&from=&to=&limit=&cursor=.
+	// upcoming — ближайшие первыми, past — последние первыми, без when — все
+	// по возрастанию. Курсор следующей страницы — в X-Next-Cursor.
 	r.GET("/appointments", func(c *gin.Context) {
-		userID := c.GetHeader("X-User-ID")
-		if userID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "нужен заголовок X-User-ID"})
+		userID, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		f, err := parseAppointmentFilter(c, userID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		rows, err := db.Query(`
-			SELECT id, user_id, slot_id, status, created_at
-			FROM appointments
-			WHERE user_id = $1`, userID)
+		list, next, err := queryAppointments(db, f)
 		if err != nil {
+			log.Printf("список записей: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
 			return
 		}
-		defer rows.Close()
+		if next != nil {
+			c.Header("X-Next-Cursor", next.encode())
+		}
+		c.JSON(http.StatusOK, list)
+	})
 
-		var list []Appointment
-		for rows.Next() {
-			var a Appointment
-			if err := rows.Scan(&a.ID, &a.UserID, &a.SlotID, &a.Status, &a.CreatedAt); err == nil {
-				list = append(list, a)
+	// Одна запись с врачом, клиникой, временем, оплатой и медкартой —
+	// пациенту и сотрудникам клиники
+	r.GET("/appointments/:id", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		d, err := loadDetails(db, id)
+		if errors.Is(err, errAppointmentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("запись %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
+			return
+		}
+		if u.ID != d.UserID && !u.worksAt(d.clinicID()) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errForbidden.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, d)
+	})
+
+	// Отмена записи. Строка остаётся со статусом "отменён" — по ней
+	// сервис платежей делает возврат, а слот предлагается листу ожидания
+	// или снова становится свободным. Пациент отменяет свою запись до срока
+	// клиники (после — если клиника разрешает, отмена считается поздней),
+	// сотрудники клиники — любую запись клиники.
+	r.DELETE("/appointments/:id", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		var req struct {
+			Reason string `json:"reason"`
+		}
+		// Причина необязательна, тело может быть пустым
+		_ = c.ShouldBindJSON(&req)
+
+		err = cancelAppointment(c.Request.Context(), db, u, id, req.Reason)
+		switch {
+		case errors.Is(err, errAppointmentNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, errNotBooked), errors.Is(err, errCancelTooLate):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			log.Printf("отмена записи %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось отменить запись"})
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	})
+
+	// Отметить приход, завершение приёма или неявку: {"status": "на приёме"}.
+	// Только сотрудники клиники; неявки также отмечаются автоматически.
+	r.PUT("/appointments/:id/status", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		var req struct {
+			Status string `json:"status"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+
+		a, err := setStatus(c.Request.Context(), db, u, id, req.Status)
+		switch {
+		case errors.Is(err, errAppointmentNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, errBadTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			log.Printf("статус записи %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось изменить статус"})
+		default:
+			c.JSON(http.StatusOK, a)
+		}
+	})
+
+	// Неявки и поздние отмены пациента по клиникам — самому пациенту и
+	// сотрудникам клиник (им — только по своей клинике)
+	r.GET("/patients/:id/attendance", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		patientID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		self := u.ID == patientID || u.Role == roleAdmin
+		if !self && (u.Role == rolePatient || u.ClinicID == nil) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "недостаточно прав"})
+			return
+		}
+		list, err := patientAttendance(db, patientID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
+			return
+		}
+		if !self {
+			visible := []Attendance{}
+			for _, at := range list {
+				if u.worksAt(at.ClinicID) {
+					visible = append(visible, at)
+				}
 			}
+			list = visible
 		}
+		c.JSON(http.StatusOK, list)
+	})
 
+	// Перенести запись на другой слот: {"slot_id": 42, "reason": "..."}.
+	// Запись и оплата остаются прежними; пациент может перенести не позднее
+	// чем за RESCHEDULE_MIN_HOURS до приёма, администратор клиники — в любое время.
+	r.POST("/appointments/:id/reschedule", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		var req struct {
+			SlotID int    `json:"slot_id"`
+			Reason string `json:"reason"`
+		}
+		if err := c.BindJSON(&req); err != nil || req.SlotID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "нужен slot_id"})
+			return
+		}
+
+		a, err := rescheduleAppointment(c.Request.Context(), db, u, id, req.SlotID, req.Reason)
+		var tooLate errTooLate
+		switch {
+		case errors.Is(err, errAppointmentNotFound), errors.Is(err, errSlotNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, errNotActive), errors.Is(err, errSameSlot), errors.Is(err, errSlotTaken),
+			errors.Is(err, errSlotInPast), errors.As(err, &tooLate):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, errSlotMismatch):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case err != nil:
+			log.Printf("перенос записи %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось перенести запись"})
+		default:
+			c.JSON(http.StatusOK, a)
+		}
+	})
+
+	// История изменений записи — пациенту и администраторам клиники
+	r.GET("/appointments/:id/history", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		patientID, clinicID, err := appointmentOwner(db, id)
+		if errors.Is(err, errAppointmentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
+			return
+		}
+		if u.ID != patientID && !u.managesClinic(clinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errForbidden.Error()})
+			return
+		}
+		list, err := listHistory(db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
+			return
+		}
 		c.JSON(http.StatusOK, list)
 	})
 
-	// Отмена записи
-	r.DELETE("/appointments/:id", func(c *gin.Context) {
-		id := c.Param("id")
-		_, err := db.Exec(`DELETE FROM appointments WHERE id = $1`, id)
+	// День клиники для администратора: ?date=ГГГГ-ММ-ДД (по умолчанию сегодня),
+	// администратор системы указывает ?clinic_id=. Все врачи со слотами,
+	// записями, отметками о приходе и загрузкой.
+	r.GET("/dashboard/day", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		var clinicID int
+		if s := c.Query("clinic_id"); s != "" {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "неверный clinic_id"})
+				return
+			}
+			clinicID = id
+		} else if u.ClinicID != nil {
+			clinicID = *u.ClinicID
+		}
+		if clinicID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "нужен clinic_id"})
+			return
+		}
+		if !u.managesClinic(clinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "недостаточно прав"})
+			return
+		}
+		date := time.Now()
+		if s := c.Query("date"); s != "" {
+			d, err := time.Parse(dateLayout, s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "date должен быть в формате ГГГГ-ММ-ДД"})
+				return
+			}
+			date = d
+		}
+
+		view, err := clinicDay(db, clinicID, date)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось отменить запись"})
+			log.Printf("день клиники %d: %v", clinicID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
+			return
+		}
+		c.JSON(http.StatusOK, view)
+	})
+
+	// Статистика по всем клиникам для администратора системы:
+	// ?period=day|week|month|quarter|year (последние N дней) или ?from=&to=.
+	// Сводка кэшируется на STATS_CACHE_SECONDS, X-Cache: hit|miss.
+	stats := newStatsCache()
+	r.GET("/stats", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		if u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "недостаточно прав"})
+			return
+		}
+		rng, err := parseStatsRange(c, time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		st, hit, err := stats.get(c.Request.Context(), db, rng)
+		if err != nil {
+			log.Printf("статистика %s: %v", rng.key(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе"})
+			return
+		}
+		if hit {
+			c.Header("X-Cache", "hit")
+		} else {
+			c.Header("X-Cache", "miss")
+		}
+		c.JSON(http.StatusOK, st)
+	})
+
+	// Встать в лист ожидания к врачу: {"doctor_id": 3, "date_from": "2026-03-10", "date_to": "2026-03-20"}.
+	// Освободившийся в окне слот придерживается для первого в очереди на
+	// WAITLIST_HOLD_MINUTES; не ответил — слот уходит следующему.
+	r.POST("/waitlist", func(c *gin.Context) {
+		userID, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		var e WaitlistEntry
+		if err := c.BindJSON(&e); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+		if err := e.validate(time.Now().Truncate(24 * time.Hour)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		e.UserID = userID
+		err := joinWaitlist(c.Request.Context(), db, &e)
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, errDoctorNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errBookingRestricted):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.As(err, &pqErr) && pqErr.Code == "23505":
+			c.JSON(http.StatusConflict, gin.H{"error": "вы уже в листе ожидания к этому врачу"})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось встать в лист ожидания"})
+		default:
+			c.JSON(http.StatusCreated, e)
+		}
+	})
+
+	// Заявки пациента; у заявки в статусе offered есть offer — придержанный слот
+	r.GET("/waitlist", func(c *gin.Context) {
+		userID, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		list, err := listWaitlist(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении листа ожидания"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	// Выйти из листа ожидания
+	r.DELETE("/waitlist/:id", func(c *gin.Context) {
+		userID, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		err = leaveWaitlist(c.Request.Context(), db, userID, id)
+		if errors.Is(err, errWaitlistNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось выйти из листа ожидания"})
 			return
 		}
 		c.Status(http.StatusNoContent)
 	})
 
+	// Принять предложенный слот — создаётся запись на приём
+	r.POST("/waitlist/:id/accept", func(c *gin.Context) {
+		userID, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		a, err := acceptOffer(c.Request.Context(), db, userID, id)
+		switch {
+		case errors.Is(err, errWaitlistNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errBookingRestricted):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, errNoOffer), errors.Is(err, errOfferExpired):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при записи"})
+		default:
+			c.JSON(http.StatusCreated, a)
+		}
+	})
+
+	// Отказаться от предложенного слота и остаться в очереди на другие
+	r.POST("/waitlist/:id/decline", func(c *gin.Context) {
+		userID, ok := requireCaller(c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		err = releaseOffer(c.Request.Context(), db, userID, id, waitlistWaiting)
+		switch {
+		case errors.Is(err, errWaitlistNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errNoOffer):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось отказаться от слота"})
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	})
+
 	if err := r.Run(":8083"); err != nil {
 		log.Fatalf("Ошибка запуска сервиса: %v", err)
 	}
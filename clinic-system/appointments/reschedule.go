@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"eventbus"
+)
+
+// Действия в истории приёма
+const historyRescheduled = "rescheduled"
+
+var (
+	errAppointmentNotFound = errors.New("запись не найдена")
+	errForbidden           = errors.New("нет доступа к записи")
+	errNotActive           = errors.New("перенести можно только активную запись")
+	errSameSlot            = errors.New("запись уже на этом слоте")
+	errSlotNotFound        = errors.New("слот не найден")
+	errSlotTaken           = errors.New("слот уже занят")
+	errSlotInPast          = errors.New("слот уже прошёл")
+	errSlotMismatch        = errors.New("перенести можно только на слот той же клиники и специальности: оплата остаётся прежней")
+)
+
+// errTooLate — перенос позже окна политики
+type errTooLate struct{ MinNotice time.Duration }
+
+func (e errTooLate) Error() string {
+	return "перенести запись можно не позднее чем за " + strconv.Itoa(int(e.MinNotice.Hours())) + " ч до приёма"
+}
+
+// reschedulePolicy — за сколько до приёма пациент ещё может перенести запись,
+// RESCHEDULE_MIN_HOURS. Администраторы клиники переносят без ограничения.
+func reschedulePolicy() time.Duration {
+	if h, err := strconv.Atoi(os.Getenv("RESCHEDULE_MIN_HOURS")); err == nil && h >= 0 {
+		return time.Duration(h) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// HistoryEntry — изменение приёма
+type HistoryEntry struct {
+	ID            int        `json:"id"`
+	AppointmentID int        `json:"appointment_id"`
+	Action        string     `json:"action"`
+	OldSlotID     *int       `json:"old_slot_id,omitempty"`
+	NewSlotID     *int       `json:"new_slot_id,omitempty"`
+	OldStart      *time.Time `json:"old_start,omitempty"`
+	NewStart      *time.Time `json:"new_start,omitempty"`
+	ChangedBy     *int       `json:"changed_by"`
+	Reason        string     `json:"reason,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// slotInfo — слот с врачом, по которому проверяется перенос
+type slotInfo struct {
+	ID        int
+	Start     time.Time
+	Available bool
+	ClinicID  int
+	Specialty string
+}
+
+// lockSlot блокирует слот до конца транзакции
+func lockSlot(ctx context.Context, tx *sql.Tx, id int) (*slotInfo, error) {
+	s := slotInfo{ID: id}
+	err := tx.QueryRowContext(ctx, `
+		SELECT s.start_time, COALESCE(s.is_available, false), COALESCE(d.clinic_id, 0), COALESCE(d.specialty, '')
+		FROM schedule_slots s
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE s.id = $1
+		FOR UPDATE OF s`, id).Scan(&s.Start, &s.Available, &s.ClinicID, &s.Specialty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSlotNotFound
+	}
+	return &s, err
+}
+
+// rescheduleAppointment переносит запись на слот newSlotID одной транзакцией:
+// новый слот занимается, старый предлагается листу ожидания или
+// освобождается. Запись (а с ней и оплата) остаётся той же.
+func rescheduleAppointment(ctx context.Context, db *sql.DB, u *caller, id, newSlotID int, reason string) (*Appointment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a := Appointment{ID: id}
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, slot_id, status, created_at FROM appointments WHERE id = $1 FOR UPDATE`, id).
+		Scan(&a.UserID, &a.SlotID, &a.Status, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errAppointmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.Status != statusBooked {
+		return nil, errNotActive
+	}
+	if a.SlotID == newSlotID {
+		return nil, errSameSlot
+	}
+
+	// Слоты блокируем по возрастанию id, чтобы встречные переносы не взаимоблокировались
+	first, second := a.SlotID, newSlotID
+	if first > second {
+		first, second = second, first
+	}
+	slots := map[int]*slotInfo{}
+	for _, sid := range []int{first, second} {
+		s, err := lockSlot(ctx, tx, sid)
+		if err != nil {
+			return nil, err
+		}
+		slots[sid] = s
+	}
+	old, next := slots[a.SlotID], slots[newSlotID]
+
+	staff := u.managesClinic(old.ClinicID)
+	if !staff && u.ID != a.UserID {
+		return nil, errForbidden
+	}
+	if notice := reschedulePolicy(); !staff && time.Until(old.Start) < notice {
+		return nil, errTooLate{MinNotice: notice}
+	}
+	if !next.Start.After(time.Now()) {
+		return nil, errSlotInPast
+	}
+	if !next.Available {
+		return nil, errSlotTaken
+	}
+	if next.ClinicID != old.ClinicID || next.Specialty != old.Specialty {
+		return nil, errSlotMismatch
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE schedule_slots SET is_available = false WHERE id = $1`, newSlotID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE appointments SET slot_id = $2 WHERE id = $1`, id, newSlotID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO appointment_history (appointment_id, action, old_slot_id, new_slot_id, old_start, new_start, changed_by, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''))`,
+		id, historyRescheduled, old.ID, next.ID, old.Start, next.Start, u.ID, reason); err != nil {
+		return nil, err
+	}
+	if err := offerSlot(ctx, tx, old.ID, waitlistHold()); err != nil {
+		return nil, err
+	}
+
+	ev, err := appointmentEvent(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	ev.PreviousSlotID, ev.PreviousStart, ev.Reason = &old.ID, &old.Start, reason
+	if err := eventbus.Publish(ctx, tx, eventbus.AppointmentRescheduled, ev); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	a.SlotID = newSlotID
+	return &a, nil
+}
+
+// appointmentOwner — пациент и клиника записи, для проверки доступа
+func appointmentOwner(db *sql.DB, id int) (patientID, clinicID int, err error) {
+	err = db.QueryRow(`
+		SELECT a.user_id, COALESCE(d.clinic_id, 0)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE a.id = $1`, id).Scan(&patientID, &clinicID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, errAppointmentNotFound
+	}
+	return patientID, clinicID, err
+}
+
+func listHistory(db *sql.DB, id int) ([]HistoryEntry, error) {
+	rows, err := db.Query(`
+		SELECT id, appointment_id, action, old_slot_id, new_slot_id, old_start, new_start,
+		       changed_by, COALESCE(reason, ''), created_at
+		FROM appointment_history WHERE appointment_id = $1 ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []HistoryEntry{}
+	for rows.Next() {
+		var h HistoryEntry
+		if err := rows.Scan(&h.ID, &h.AppointmentID, &h.Action, &h.OldSlotID, &h.NewSlotID, &h.OldStart, &h.NewStart,
+			&h.ChangedBy, &h.Reason, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, h)
+	}
+	return list, rows.Err()
+}
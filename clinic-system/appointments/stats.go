@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// paidStatuses — статусы платежей сервиса payments, по которым деньги получены
+// (возвраты учитываются отдельно)
+var paidStatuses = []string{"succeeded", "partially_refunded", "refunded"}
+
+// statsPeriods — выбираемые периоды: последние N дней, включая сегодня
+var statsPeriods = map[string]int{"day": 1, "week": 7, "month": 30, "quarter": 90, "year": 365}
+
+// statsRange — период статистики: даты включительно
+type statsRange struct {
+	From time.Time
+	To   time.Time
+}
+
+func (r statsRange) key() string {
+	return r.From.Format(dateLayout) + "/" + r.To.Format(dateLayout)
+}
+
+// parseStatsRange разбирает ?period= или ?from=&to=; по умолчанию — месяц
+func parseStatsRange(c *gin.Context, today time.Time) (statsRange, error) {
+	from, to, err := parseDateRange(c)
+	if err != nil {
+		return statsRange{}, err
+	}
+	if from != nil || to != nil {
+		if from == nil || to == nil {
+			return statsRange{}, fmt.Errorf("нужны обе даты: from и to")
+		}
+		r := statsRange{From: *from, To: to.AddDate(0, 0, -1)}
+		if r.To.Before(r.From) {
+			return statsRange{}, fmt.Errorf("to раньше from")
+		}
+		if r.To.Sub(r.From) > 2*365*24*time.Hour {
+			return statsRange{}, fmt.Errorf("период не длиннее двух лет")
+		}
+		return r, nil
+	}
+	period := c.DefaultQuery("period", "month")
+	days, ok := statsPeriods[period]
+	if !ok {
+		return statsRange{}, fmt.Errorf("period: day, week, month, quarter или year")
+	}
+	return statsRange{From: today.AddDate(0, 0, 1-days), To: today}, nil
+}
+
+// RoleCount — пользователи роли
+type RoleCount struct {
+	Role  string `json:"role"`
+	Total int    `json:"total"`
+	// Active — с приёмами в периоде (для пациентов); у остальных ролей
+	// активность не отслеживается и совпадает с Total
+	Active int `json:"active"`
+}
+
+// DayCount — приёмы за день по времени слота
+type DayCount struct {
+	Date      string `json:"date"`
+	Total     int    `json:"total"`
+	Completed int    `json:"completed"`
+	Cancelled int    `json:"cancelled"`
+	NoShows   int    `json:"no_shows"`
+}
+
+// Rates — доли в процентах. Отмены — от всех записей периода, неявки —
+// от записей, время которых наступило и которые не были отменены.
+type Rates struct {
+	Cancellation     float64 `json:"cancellation_percent"`
+	LateCancellation float64 `json:"late_cancellation_percent"`
+	NoShow           float64 `json:"no_show_percent"`
+}
+
+// Revenue — выручка в одной валюте, минорные единицы
+type Revenue struct {
+	Currency      string `json:"currency"`
+	GrossMinor    int64  `json:"gross_minor"`
+	RefundedMinor int64  `json:"refunded_minor"`
+	NetMinor      int64  `json:"net_minor"`
+}
+
+// Busiest — врач или специальность с числом состоявшихся и предстоящих приёмов
+type Busiest struct {
+	DoctorID     *int   `json:"doctor_id,omitempty"`
+	Name         string `json:"name"`
+	ClinicID     *int   `json:"clinic_id,omitempty"`
+	Appointments int    `json:"appointments"`
+}
+
+// SystemStats — сводка по всем клиникам за период
+type SystemStats struct {
+	From               string      `json:"from"`
+	To                 string      `json:"to"`
+	Users              []RoleCount `json:"users"`
+	AppointmentsPerDay []DayCount  `json:"appointments_per_day"`
+	Rates              Rates       `json:"rates"`
+	Revenue            []Revenue   `json:"revenue"`
+	BusiestDoctors     []Busiest   `json:"busiest_doctors"`
+	BusiestSpecialties []Busiest   `json:"busiest_specialties"`
+	GeneratedAt        time.Time   `json:"generated_at"`
+}
+
+// systemStats собирает сводку. Запросы тяжёлые, поэтому результат кэшируется.
+func systemStats(ctx context.Context, db *sql.DB, r statsRange) (*SystemStats, error) {
+	// Верхняя граница не включительно
+	from, to := r.From.Format(dateLayout), r.To.AddDate(0, 0, 1).Format(dateLayout)
+	st := SystemStats{From: r.From.Format(dateLayout), To: r.To.Format(dateLayout), GeneratedAt: time.Now()}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(u.role, ''), COUNT(*),
+		       COUNT(*) FILTER (WHERE u.role <> $3 OR EXISTS (
+		           SELECT 1 FROM appointments a JOIN schedule_slots s ON s.id = a.slot_id
+		           WHERE a.user_id = u.id AND s.start_time >= $1::DATE AND s.start_time < $2::DATE))
+		FROM users u
+		GROUP BY 1
+		ORDER BY 1`, from, to, rolePatient)
+	if err != nil {
+		return nil, err
+	}
+	st.Users = []RoleCount{}
+	for rows.Next() {
+		var rc RoleCount
+		if err := rows.Scan(&rc.Role, &rc.Total, &rc.Active); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		st.Users = append(st.Users, rc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT s.start_time::DATE, COUNT(*),
+		       COUNT(*) FILTER (WHERE a.status = $3),
+		       COUNT(*) FILTER (WHERE a.status = $4),
+		       COUNT(*) FILTER (WHERE a.status = $5)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		WHERE s.start_time >= $1::DATE AND s.start_time < $2::DATE
+		GROUP BY 1
+		ORDER BY 1`, from, to, statusCompleted, statusCancelled, statusNoShow)
+	if err != nil {
+		return nil, err
+	}
+	st.AppointmentsPerDay = []DayCount{}
+	var total, cancelled, noShows int
+	for rows.Next() {
+		var d DayCount
+		var day time.Time
+		if err := rows.Scan(&day, &d.Total, &d.Completed, &d.Cancelled, &d.NoShows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.Date = day.Format(dateLayout)
+		total, cancelled, noShows = total+d.Total, cancelled+d.Cancelled, noShows+d.NoShows
+		st.AppointmentsPerDay = append(st.AppointmentsPerDay, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var late, due int
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FILTER (WHERE a.status = $3 AND a.cancelled_late),
+		       COUNT(*) FILTER (WHERE a.status <> $3 AND s.start_time < NOW())
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		WHERE s.start_time >= $1::DATE AND s.start_time < $2::DATE`, from, to, statusCancelled).Scan(&late, &due)
+	if err != nil {
+		return nil, err
+	}
+	st.Rates = Rates{
+		Cancellation:     percent(cancelled, total),
+		LateCancellation: percent(late, total),
+		NoShow:           percent(noShows, due),
+	}
+
+	// Оплаты — по дате платежа, возвраты — по дате возврата
+	rows, err = db.QueryContext(ctx, `
+		SELECT currency, SUM(gross)::BIGINT, SUM(refunded)::BIGINT FROM (
+			SELECT p.currency, p.amount_minor AS gross, 0 AS refunded
+			FROM payments p
+			WHERE p.payment_status = ANY($3) AND p.payment_date >= $1::DATE AND p.payment_date < $2::DATE
+			UNION ALL
+			SELECT p.currency, 0, r.amount_minor
+			FROM payment_refunds r
+			JOIN payments p ON p.id = r.payment_id
+			WHERE r.status = 'succeeded' AND r.created_at >= $1::DATE AND r.created_at < $2::DATE
+		) e
+		GROUP BY currency
+		ORDER BY currency`, from, to, pq.Array(paidStatuses))
+	if err != nil {
+		return nil, err
+	}
+	st.Revenue = []Revenue{}
+	for rows.Next() {
+		var rv Revenue
+		if err := rows.Scan(&rv.Currency, &rv.GrossMinor, &rv.RefundedMinor); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rv.NetMinor = rv.GrossMinor - rv.RefundedMinor
+		st.Revenue = append(st.Revenue, rv)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if st.BusiestDoctors, err = busiest(ctx, db, `
+		SELECT d.id, COALESCE(d.full_name, ''), d.clinic_id, COUNT(*)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE s.start_time >= $1::DATE AND s.start_time < $2::DATE AND a.status <> $3
+		GROUP BY d.id
+		ORDER BY 4 DESC, d.id
+		LIMIT 10`, from, to); err != nil {
+		return nil, err
+	}
+	if st.BusiestSpecialties, err = busiest(ctx, db, `
+		SELECT NULL::INTEGER, COALESCE(d.specialty, ''), NULL::INTEGER, COUNT(*)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE s.start_time >= $1::DATE AND s.start_time < $2::DATE AND a.status <> $3
+		GROUP BY 2
+		ORDER BY 4 DESC, 2
+		LIMIT 10`, from, to); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// busiest выполняет запрос рейтинга врачей или специальностей; отменённые
+// записи не считаются
+func busiest(ctx context.Context, db *sql.DB, query, from, to string) ([]Busiest, error) {
+	rows, err := db.QueryContext(ctx, query, from, to, statusCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Busiest{}
+	for rows.Next() {
+		var b Busiest
+		if err := rows.Scan(&b.DoctorID, &b.Name, &b.ClinicID, &b.Appointments); err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	return list, rows.Err()
+}
+
+// statsCache хранит сводки по ключу периода STATS_CACHE_SECONDS. Один
+// период считается одним запросом, даже если его ждут несколько клиентов.
+type statsCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*statsEntry
+}
+
+type statsEntry struct {
+	ready   chan struct{} // закрывается, когда расчёт завершён
+	stats   *SystemStats
+	err     error
+	expires time.Time
+}
+
+func newStatsCache() *statsCache {
+	ttl := 5 * time.Minute
+	if sec, err := strconv.Atoi(os.Getenv("STATS_CACHE_SECONDS")); err == nil && sec >= 0 {
+		ttl = time.Duration(sec) * time.Second
+	}
+	return &statsCache{ttl: ttl, entries: map[string]*statsEntry{}}
+}
+
+// get отдаёт сводку из кэша или считает её; hit — взята из кэша
+func (sc *statsCache) get(ctx context.Context, db *sql.DB, r statsRange) (st *SystemStats, hit bool, err error) {
+	key := r.key()
+	sc.mu.Lock()
+	e, ok := sc.entries[key]
+	if ok && e.expires.IsZero() || ok && time.Now().Before(e.expires) {
+		sc.mu.Unlock()
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if e.err != nil {
+			return nil, false, e.err
+		}
+		return e.stats, true, nil
+	}
+	// Просроченные записи других периодов заодно выбрасываем
+	for k, old := range sc.entries {
+		if !old.expires.IsZero() && time.Now().After(old.expires) {
+			delete(sc.entries, k)
+		}
+	}
+	e = &statsEntry{ready: make(chan struct{})}
+	sc.entries[key] = e
+	sc.mu.Unlock()
+
+	// Считаем без контекста запроса: результат нужен и другим ожидающим
+	e.stats, e.err = systemStats(context.Background(), db, r)
+	sc.mu.Lock()
+	if e.err != nil {
+		delete(sc.entries, key)
+	} else {
+		e.expires = time.Now().Add(sc.ttl)
+	}
+	sc.mu.Unlock()
+	close(e.ready)
+	return e.stats, false, e.err
+}
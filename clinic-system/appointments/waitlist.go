@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"eventbus"
+)
+
+// Статусы заявки в листе ожидания
+const (
+	waitlistWaiting   = "waiting"
+	waitlistOffered   = "offered"
+	waitlistBooked    = "booked"
+	waitlistCancelled = "cancelled"
+	waitlistExpired   = "expired"
+)
+
+// Статусы брони слота
+const (
+	holdActive   = "active"
+	holdAccepted = "accepted"
+	holdDeclined = "declined"
+	holdExpired  = "expired"
+)
+
+const dateLayout = "2006-01-02"
+
+var (
+	errWaitlistNotFound = errors.New("заявка не найдена")
+	errNoOffer          = errors.New("по заявке нет предложенного слота")
+	errOfferExpired     = errors.New("время брони слота истекло")
+	errDoctorNotFound   = errors.New("врач не найден")
+)
+
+// SlotOffer — слот, придержанный для пациента
+type SlotOffer struct {
+	HoldID    int       `json:"hold_id"`
+	SlotID    int       `json:"slot_id"`
+	Start     time.Time `json:"start"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// WaitlistEntry — заявка пациента на освободившийся слот врача
+type WaitlistEntry struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	DoctorID  int        `json:"doctor_id"`
+	DateFrom  string     `json:"date_from"` // YYYY-MM-DD, включительно
+	DateTo    string     `json:"date_to"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	Offer     *SlotOffer `json:"offer,omitempty"`
+}
+
+// waitlistHold — сколько слот ждёт ответа пациента, WAITLIST_HOLD_MINUTES
+func waitlistHold() time.Duration {
+	if m, err := strconv.Atoi(os.Getenv("WAITLIST_HOLD_MINUTES")); err == nil && m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return 30 * time.Minute
+}
+
+// validate проверяет окно дат: не в прошлом и не длиннее 90 дней
+func (e *WaitlistEntry) validate(today time.Time) error {
+	from, err := time.Parse(dateLayout, e.DateFrom)
+	if err != nil {
+		return errors.New("неверный date_from, ожидается YYYY-MM-DD")
+	}
+	to, err := time.Parse(dateLayout, e.DateTo)
+	if err != nil {
+		return errors.New("неверный date_to, ожидается YYYY-MM-DD")
+	}
+	if to.Before(from) {
+		return errors.New("date_to раньше date_from")
+	}
+	if to.Before(today) {
+		return errors.New("окно дат уже прошло")
+	}
+	if to.Sub(from) > 90*24*time.Hour {
+		return errors.New("окно дат не длиннее 90 дней")
+	}
+	return nil
+}
+
+// joinWaitlist ставит пациента в очередь к врачу
+func joinWaitlist(ctx context.Context, db *sql.DB, e *WaitlistEntry) error {
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM doctors WHERE id = $1)`, e.DoctorID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errDoctorNotFound
+	}
+	if err := checkBookingAllowed(ctx, db, e.UserID, e.DoctorID); err != nil {
+		return err
+	}
+	e.Status = waitlistWaiting
+	return db.QueryRowContext(ctx, `
+		INSERT INTO waitlist_entries (user_id, doctor_id, date_from, date_to)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at`,
+		e.UserID, e.DoctorID, e.DateFrom, e.DateTo).Scan(&e.ID, &e.CreatedAt)
+}
+
+// listWaitlist — заявки пациента с действующими предложениями, новые первыми
+func listWaitlist(db *sql.DB, userID int) ([]WaitlistEntry, error) {
+	rows, err := db.Query(`
+		SELECT w.id, w.user_id, w.doctor_id, w.date_from, w.date_to, w.status, w.created_at,
+		       h.id, h.slot_id, s.start_time, h.expires_at
+		FROM waitlist_entries w
+		LEFT JOIN slot_holds h ON h.waitlist_id = w.id AND h.status = $2
+		LEFT JOIN schedule_slots s ON s.id = h.slot_id
+		WHERE w.user_id = $1
+		ORDER BY w.created_at DESC, w.id DESC`, userID, holdActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []WaitlistEntry{}
+	for rows.Next() {
+		var e WaitlistEntry
+		var from, to time.Time
+		var holdID, slotID sql.NullInt64
+		var start, expires sql.NullTime
+		if err := rows.Scan(&e.ID, &e.UserID, &e.DoctorID, &from, &to, &e.Status, &e.CreatedAt,
+			&holdID, &slotID, &start, &expires); err != nil {
+			return nil, err
+		}
+		e.DateFrom, e.DateTo = from.Format(dateLayout), to.Format(dateLayout)
+		if holdID.Valid {
+			e.Offer = &SlotOffer{HoldID: int(holdID.Int64), SlotID: int(slotID.Int64), Start: start.Time, ExpiresAt: expires.Time}
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// offerSlot предлагает освободившийся слот следующему в очереди к врачу:
+// самой ранней ожидающей заявке, в окно которой попадает слот и которой
+// этот слот ещё не предлагали. Если предложить некому, слот становится
+// свободным. Вызывается в транзакции, освободившей слот.
+func offerSlot(ctx context.Context, tx *sql.Tx, slotID int, hold time.Duration) error {
+	var offer eventbus.WaitlistOffer
+	err := tx.QueryRowContext(ctx, `
+		SELECT w.id, w.user_id, s.id, d.id, COALESCE(d.clinic_id, 0), s.start_time
+		FROM schedule_slots s
+		JOIN doctors d ON d.id = s.doctor_id
+		JOIN waitlist_entries w ON w.doctor_id = s.doctor_id
+		WHERE s.id = $1
+		  AND s.start_time > NOW()
+		  AND w.status = $2
+		  AND s.start_time::DATE BETWEEN w.date_from AND w.date_to
+		  AND NOT EXISTS (SELECT 1 FROM slot_holds h WHERE h.slot_id = s.id AND h.waitlist_id = w.id)
+		ORDER BY w.created_at, w.id
+		LIMIT 1
+		FOR UPDATE OF w SKIP LOCKED`, slotID, waitlistWaiting).
+		Scan(&offer.WaitlistID, &offer.PatientID, &offer.SlotID, &offer.DoctorID, &offer.ClinicID, &offer.Start)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.ExecContext(ctx, `UPDATE schedule_slots SET is_available = true WHERE id = $1`, slotID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// Бронь не переживает начало приёма
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO slot_holds (slot_id, waitlist_id, expires_at)
+		VALUES ($1, $2, LEAST(NOW() + make_interval(secs => $3), $4))
+		RETURNING id, expires_at`, slotID, offer.WaitlistID, hold.Seconds(), offer.Start).
+		Scan(&offer.HoldID, &offer.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE waitlist_entries SET status = $2, updated_at = NOW() WHERE id = $1`, offer.WaitlistID, waitlistOffered); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE schedule_slots SET is_available = false WHERE id = $1`, slotID); err != nil {
+		return err
+	}
+	return eventbus.Publish(ctx, tx, eventbus.WaitlistOffered, offer)
+}
+
+// lockOffer блокирует заявку пациента и её действующую бронь
+func lockOffer(ctx context.Context, tx *sql.Tx, userID, waitlistID int) (holdID, slotID int, expired bool, err error) {
+	var status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT status FROM waitlist_entries WHERE id = $1 AND user_id = $2 FOR UPDATE`, waitlistID, userID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, false, errWaitlistNotFound
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if status != waitlistOffered {
+		return 0, 0, false, errNoOffer
+	}
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, slot_id, expires_at <= NOW() FROM slot_holds
+		WHERE waitlist_id = $1 AND status = $2 FOR UPDATE`, waitlistID, holdActive).Scan(&holdID, &slotID, &expired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, false, errNoOffer
+	}
+	return holdID, slotID, expired, err
+}
+
+// acceptOffer записывает пациента на придержанный для него слот
+func acceptOffer(ctx context.Context, db *sql.DB, userID, waitlistID int) (*Appointment, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	holdID, slotID, expired, err := lockOffer(ctx, tx, userID, waitlistID)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		// Истёкшую бронь сам не снимаем — это сделает обход с передачей следующему
+		return nil, errOfferExpired
+	}
+	var doctorID int
+	if err := tx.QueryRowContext(ctx, `SELECT doctor_id FROM schedule_slots WHERE id = $1`, slotID).Scan(&doctorID); err != nil {
+		return nil, err
+	}
+	if err := checkBookingAllowed(ctx, tx, userID, doctorID); err != nil {
+		return nil, err
+	}
+
+	a := Appointment{UserID: userID, SlotID: slotID, Status: statusBooked}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO appointments (user_id, slot_id, status)
+		VALUES ($1, $2, $3) RETURNING id, created_at`, a.UserID, a.SlotID, a.Status).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE slot_holds SET status = $2 WHERE id = $1`, holdID, holdAccepted); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE waitlist_entries SET status = $2, updated_at = NOW() WHERE id = $1`, waitlistID, waitlistBooked); err != nil {
+		return nil, err
+	}
+	if err := publishAppointment(ctx, tx, eventbus.AppointmentBooked, a.ID); err != nil {
+		return nil, err
+	}
+	return &a, tx.Commit()
+}
+
+// releaseOffer снимает действующую бронь заявки (отказ или выход из очереди),
+// переводит заявку в next и передаёт слот следующему
+func releaseOffer(ctx context.Context, db *sql.DB, userID, waitlistID int, next string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	holdID, slotID, _, err := lockOffer(ctx, tx, userID, waitlistID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE slot_holds SET status = $2 WHERE id = $1`, holdID, holdDeclined); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE waitlist_entries SET status = $2, updated_at = NOW() WHERE id = $1`, waitlistID, next); err != nil {
+		return err
+	}
+	if err := offerSlot(ctx, tx, slotID, waitlistHold()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// leaveWaitlist убирает заявку из очереди; придержанный слот уходит следующему
+func leaveWaitlist(ctx context.Context, db *sql.DB, userID, waitlistID int) error {
+	err := releaseOffer(ctx, db, userID, waitlistID, waitlistCancelled)
+	if !errors.Is(err, errNoOffer) {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE waitlist_entries SET status = $3, updated_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND status = $4`, waitlistID, userID, waitlistCancelled, waitlistWaiting)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errWaitlistNotFound
+	}
+	return nil
+}
+
+// expireHold снимает одну истёкшую бронь и передаёт слот следующему.
+// Возвращает false, когда истёкших броней не осталось. Блокировки берутся
+// в том же порядке, что и в lockOffer (заявка, затем бронь), иначе ответ
+// пациента в момент истечения брони взаимно блокируется с обходом.
+func expireHold(ctx context.Context, db *sql.DB, hold time.Duration) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var holdID, slotID, waitlistID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, slot_id, waitlist_id FROM slot_holds
+		WHERE status = $1 AND expires_at <= NOW()
+		ORDER BY expires_at
+		LIMIT 1`, holdActive).Scan(&holdID, &slotID, &waitlistID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM waitlist_entries WHERE id = $1 FOR UPDATE`, waitlistID); err != nil {
+		return false, err
+	}
+	// Пока ждали блокировку, пациент мог принять предложение или другой
+	// обход — снять бронь: тогда её уже нет среди действующих
+	var active bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT status = $2 FROM slot_holds WHERE id = $1 FOR UPDATE`, holdID, holdActive).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+	if !active {
+		return true, nil
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE slot_holds SET status = $2 WHERE id = $1`, holdID, holdExpired); err != nil {
+		return false, err
+	}
+	// Пациент, не успевший ответить, остаётся в очереди на другие слоты
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE waitlist_entries SET status = $2, updated_at = NOW() WHERE id = $1 AND status = $3`,
+		waitlistID, waitlistWaiting, waitlistOffered); err != nil {
+		return false, err
+	}
+	if err := offerSlot(ctx, tx, slotID, hold); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// runWaitlistSweeper раз в every передаёт истёкшие брони дальше по очереди
+// и закрывает заявки, окно которых прошло
+func runWaitlistSweeper(db *sql.DB, every time.Duration) {
+	ctx := context.Background()
+	for {
+		for {
+			more, err := expireHold(ctx, db, waitlistHold())
+			if err != nil {
+				log.Printf("лист ожидания: истёкшие брони: %v", err)
+			}
+			if !more || err != nil {
+				break
+			}
+		}
+		if _, err := db.ExecContext(ctx, `
+			UPDATE waitlist_entries SET status = $1, updated_at = NOW()
+			WHERE status = $2 AND date_to < CURRENT_DATE`, waitlistExpired, waitlistWaiting); err != nil {
+			log.Printf("лист ожидания: прошедшие заявки: %v", err)
+		}
+		time.Sleep(every)
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
@@ -16,8 +19,18 @@ type Clinic struct {
 	Name    string `json:"name"`
 	Address string `json:"address"`
 	Phone   string `json:"phone"`
+	// Валюта ISO 4217: в ней задаются цены и принимается оплата
+	Currency string `json:"currency"`
 }
 
+// Валюты, с которыми умеет работать сервис платежей
+var supportedCurrencies = map[string]bool{
+	"RUB": true, "BYN": true, "KZT": true, "UZS": true, "KGS": true, "AMD": true,
+	"GEL": true, "USD": true, "EUR": true, "JPY": true, "KRW": true, "KWD": true,
+}
+
+const defaultCurrency = "RUB"
+
 func main() {
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -39,12 +52,20 @@ func main() {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный JSON"})
 			return
 		}
+		clinic.Currency = strings.ToUpper(strings.TrimSpace(clinic.Currency))
+		if clinic.Currency == "" {
+			clinic.Currency = defaultCurrency
+		}
+		if !supportedCurrencies[clinic.Currency] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неподдерживаемая валюта"})
+			return
+		}
 
 		err := db.QueryRow(`
-			INSERT INTO clinics (city, name, address, phone)
-			VALUES ($1, $2, $3, $4)
+			INSERT INTO clinics (city, name, address, phone, currency)
+			VALUES ($1, $2, $3, $4, $5)
 			RETURNING id`,
-			clinic.City, clinic.Name, clinic.Address, clinic.Phone).Scan(&clinic.ID)
+			clinic.City, clinic.Name, clinic.Address, clinic.Phone, clinic.Currency).Scan(&clinic.ID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось создать клинику"})
 			return
@@ -55,7 +76,7 @@ func main() {
 
 	// GET /clinics — список всех клиник
 	r.GET("/clinics", func(c *gin.Context) {
-		rows, err := db.Query(`SELECT id, city, name, address, phone FROM clinics`)
+		rows, err := db.Query(`SELECT id, city, name, address, phone, currency FROM clinics`)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе клиник"})
 			return
@@ -65,7 +86,7 @@ func main() {
 		var clinics []Clinic
 		for rows.Next() {
 			var cl Clinic
-			if err := rows.Scan(&cl.ID, &cl.City, &cl.Name, &cl.Address, &cl.Phone); err == nil {
+			if err := rows.Scan(&cl.ID, &cl.City, &cl.Name, &cl.Address, &cl.Phone, &cl.Currency); err == nil {
 				clinics = append(clinics, cl)
 			}
 		}
@@ -94,6 +115,56 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"message": "Администратор назначен"})
 	})
 
+	// Правила отмены и неявок клиники
+	r.GET("/clinics/:id/policy", func(c *gin.Context) {
+		clinicID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		p, err := loadPolicy(db, clinicID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "клиника не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе правил"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	// Изменить правила — администратор клиники или системы
+	r.PUT("/clinics/:id/policy", func(c *gin.Context) {
+		clinicID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		if !requireClinicManager(db, c, clinicID) {
+			return
+		}
+		var p Policy
+		if err := c.BindJSON(&p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный JSON"})
+			return
+		}
+		if err := p.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err = savePolicy(db, clinicID, &p)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "клиника не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сохранить правила"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
 	if err := r.Run(":8087"); err != nil {
 		log.Fatal("Ошибка запуска clinics сервиса:", err)
 	}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Policy — правила отмены и неявок клиники
+type Policy struct {
+	// Пациент, отменяющий позже чем за CancellationCutoffHours до приёма,
+	// отменяет поздно
+	CancellationCutoffHours int `json:"cancellation_cutoff_hours"`
+	// false — поздняя отмена пациентом запрещена
+	LateCancellationAllowed bool `json:"late_cancellation_allowed"`
+	// Сколько неявок за NoShowWindowDays закрывают пациенту запись; nil — без ограничения
+	NoShowLimit      *int `json:"no_show_limit"`
+	NoShowWindowDays int  `json:"no_show_window_days"`
+}
+
+func (p *Policy) validate() error {
+	if p.CancellationCutoffHours < 0 || p.CancellationCutoffHours > 14*24 {
+		return errors.New("cancellation_cutoff_hours: от 0 до 336")
+	}
+	if p.NoShowLimit != nil && *p.NoShowLimit < 1 {
+		return errors.New("no_show_limit должен быть положительным")
+	}
+	if p.NoShowWindowDays < 1 || p.NoShowWindowDays > 3*365 {
+		return errors.New("no_show_window_days: от 1 до 1095")
+	}
+	return nil
+}
+
+func loadPolicy(db *sql.DB, clinicID int) (*Policy, error) {
+	var p Policy
+	err := db.QueryRow(`
+		SELECT cancellation_cutoff_hours, late_cancellation_allowed, no_show_limit, no_show_window_days
+		FROM clinics WHERE id = $1`, clinicID).
+		Scan(&p.CancellationCutoffHours, &p.LateCancellationAllowed, &p.NoShowLimit, &p.NoShowWindowDays)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func savePolicy(db *sql.DB, clinicID int, p *Policy) error {
+	res, err := db.Exec(`
+		UPDATE clinics SET cancellation_cutoff_hours = $2, late_cancellation_allowed = $3,
+		                   no_show_limit = $4, no_show_window_days = $5
+		WHERE id = $1`,
+		clinicID, p.CancellationCutoffHours, p.LateCancellationAllowed, p.NoShowLimit, p.NoShowWindowDays)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// requireClinicManager пропускает администратора клиники clinicID и
+// администратора системы. При ошибке сам отвечает клиенту.
+func requireClinicManager(db *sql.DB, c *gin.Context, clinicID int) bool {
+	userID, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "нужен заголовок X-User-ID"})
+		return false
+	}
+	var role sql.NullString
+	var userClinic sql.NullInt64
+	err = db.QueryRow(`SELECT role, clinic_id FROM users WHERE id = $1`, userID).Scan(&role, &userClinic)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "пользователь не найден"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+		return false
+	}
+	if role.String == "admin" || (role.String == "clinic_admin" && userClinic.Valid && int(userClinic.Int64) == clinicID) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "недостаточно прав"})
+	return false
+}
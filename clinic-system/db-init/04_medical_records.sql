@@ -1,8 +0,0 @@
-CREATE TABLE IF NOT EXISTS medical_records (
-    id SERIAL PRIMARY KEY,
-    user_id INTEGER REFERENCES users(id),
-    doctor_id INTEGER REFERENCES doctors(id),
-    record_date DATE,
-    diagnosis TEXT,
-    notes TEXT
-);
@@ -1,14 +1,13 @@
-CREATE TABLE IF NOT EXISTS transactions (
+CREATE TABLE IF NOT EXISTS payments (
     id SERIAL PRIMARY KEY,
-    user_id INTEGER REFERENCES users(id),
-    amount NUMERIC(10, 2),
-    status VARCHAR(50),
-    created_at TIMESTAMP DEFAULT NOW()
-);
-
-CREATE TABLE IF NOT EXISTS receipts (
-    id SERIAL PRIMARY KEY,
-    transaction_id INTEGER REFERENCES transactions(id),
-    issued_at TIMESTAMP DEFAULT NOW(),
-    details TEXT
+    appointment_id INTEGER NOT NULL REFERENCES appointments(id),
+    service VARCHAR(100) NOT NULL DEFAULT 'consultation',
+    -- Суммы — целые минорные единицы валюты (копейки, центы), см. 16_money.sql
+    amount_minor BIGINT NOT NULL CHECK (amount_minor >= 0),
+    currency CHAR(3) NOT NULL,
+    payment_date TIMESTAMP DEFAULT NOW(),
+    payment_status VARCHAR(50) NOT NULL
 );
+-- Одна действующая оплата на приём; неудачные попытки не мешают повторной
+CREATE UNIQUE INDEX IF NOT EXISTS payments_appointment_idx
+    ON payments (appointment_id) WHERE payment_status <> 'failed';
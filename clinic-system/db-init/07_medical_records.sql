@@ -1,8 +1,8 @@
 CREATE TABLE IF NOT EXISTS medical_records (
     id SERIAL PRIMARY KEY,
-    patient_id INTEGER,
-    doctor_id INTEGER,
-    appointment_id INTEGER,
+    patient_id INTEGER NOT NULL REFERENCES users(id),
+    doctor_id INTEGER NOT NULL REFERENCES doctors(id),
+    appointment_id INTEGER NOT NULL UNIQUE REFERENCES appointments(id),
     diagnosis TEXT,
     treatment TEXT,
     visit_date DATE
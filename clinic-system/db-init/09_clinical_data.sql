@@ -0,0 +1,34 @@
+-- Справочник МКБ-10, загружается через POST /icd10/import или ICD10_PATH
+CREATE TABLE IF NOT EXISTS icd10_codes (
+    code VARCHAR(10) PRIMARY KEY,
+    title TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS icd10_codes_title_idx ON icd10_codes (lower(title));
+
+CREATE TABLE IF NOT EXISTS record_diagnoses (
+    id SERIAL PRIMARY KEY,
+    record_id INTEGER NOT NULL REFERENCES medical_records(id) ON DELETE CASCADE,
+    icd10_code VARCHAR(10) NOT NULL REFERENCES icd10_codes(code),
+    is_primary BOOLEAN NOT NULL DEFAULT false,
+    note TEXT
+);
+CREATE INDEX IF NOT EXISTS record_diagnoses_code_idx ON record_diagnoses (icd10_code);
+
+CREATE TABLE IF NOT EXISTS prescriptions (
+    id SERIAL PRIMARY KEY,
+    record_id INTEGER NOT NULL REFERENCES medical_records(id) ON DELETE CASCADE,
+    drug VARCHAR(255) NOT NULL,
+    dose VARCHAR(100) NOT NULL,
+    frequency VARCHAR(100) NOT NULL,
+    duration_days INTEGER,
+    notes TEXT
+);
+
+CREATE TABLE IF NOT EXISTS vitals (
+    record_id INTEGER PRIMARY KEY REFERENCES medical_records(id) ON DELETE CASCADE,
+    systolic INTEGER,
+    diastolic INTEGER,
+    pulse INTEGER,
+    temperature NUMERIC(4, 1),
+    weight NUMERIC(5, 2)
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS record_attachments (
+    id SERIAL PRIMARY KEY,
+    record_id INTEGER NOT NULL REFERENCES medical_records(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL, -- lab_result, scan, referral, other
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    storage_key VARCHAR(255) NOT NULL UNIQUE,
+    uploaded_by INTEGER REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS record_attachments_record_idx ON record_attachments (record_id);
@@ -0,0 +1,7 @@
+-- Ключи данных для шифрования полей медкарты; хранятся обёрнутыми мастер-ключом
+CREATE TABLE IF NOT EXISTS data_keys (
+    id SERIAL PRIMARY KEY,
+    master_key_id VARCHAR(50) NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
@@ -0,0 +1,9 @@
+-- Прайс-лист клиники. Пустая specialty — цена услуги для любой специальности.
+CREATE TABLE IF NOT EXISTS price_list (
+    id SERIAL PRIMARY KEY,
+    clinic_id INTEGER NOT NULL REFERENCES clinics(id),
+    specialty VARCHAR(100) NOT NULL DEFAULT '',
+    service VARCHAR(100) NOT NULL DEFAULT 'consultation',
+    price_minor BIGINT NOT NULL CHECK (price_minor >= 0), -- в валюте клиники
+    UNIQUE (clinic_id, specialty, service)
+);
@@ -0,0 +1,38 @@
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider VARCHAR(50);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS provider_intent_id VARCHAR(100);
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS confirmation_url TEXT;
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT NOW();
+CREATE UNIQUE INDEX IF NOT EXISTS payments_provider_intent_idx ON payments (provider, provider_intent_id);
+
+-- Платежи, созданные до появления провайдера, считаем успешными
+UPDATE payments SET payment_status = 'succeeded' WHERE payment_status = 'paid';
+
+-- История статусов: pending → succeeded / failed и далее
+CREATE TABLE IF NOT EXISTS payment_status_history (
+    id SERIAL PRIMARY KEY,
+    payment_id INTEGER NOT NULL REFERENCES payments(id),
+    from_status VARCHAR(50),
+    to_status VARCHAR(50) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS payment_status_history_payment_idx ON payment_status_history (payment_id);
+
+-- Платежи тестового провайдера (PAYMENT_PROVIDER=fake). Хранятся в БД,
+-- чтобы списание и возврат работали и после перезапуска сервиса.
+CREATE TABLE IF NOT EXISTS fake_provider_intents (
+    id VARCHAR(100) PRIMARY KEY,
+    amount_minor BIGINT NOT NULL,
+    status VARCHAR(20) NOT NULL, -- created, authorized, captured, failed
+    refunded_minor BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Уже обработанные вебхуки, чтобы повторная доставка ничего не меняла
+CREATE TABLE IF NOT EXISTS processed_webhook_events (
+    provider VARCHAR(50) NOT NULL,
+    event_id VARCHAR(100) NOT NULL,
+    event_type VARCHAR(50),
+    processed_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (provider, event_id)
+);
@@ -0,0 +1,20 @@
+-- Отмена приёма больше не удаляет строку: фиксируем, кто и когда отменил
+ALTER TABLE appointments ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP;
+ALTER TABLE appointments ADD COLUMN IF NOT EXISTS cancelled_by INTEGER REFERENCES users(id);
+ALTER TABLE appointments ADD COLUMN IF NOT EXISTS cancel_reason TEXT;
+
+CREATE TABLE IF NOT EXISTS payment_refunds (
+    id SERIAL PRIMARY KEY,
+    payment_id INTEGER NOT NULL REFERENCES payments(id),
+    amount_minor BIGINT NOT NULL CHECK (amount_minor > 0), -- в валюте платежа
+    reason TEXT,
+    initiated_by INTEGER REFERENCES users(id), -- NULL у автоматических возвратов
+    provider_refund_id VARCHAR(100),
+    -- pending — записан до вызова провайдера, succeeded/failed — ответ провайдера
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS payment_refunds_payment_idx ON payment_refunds (payment_id);
+
+-- Когда сервис платежей обработал отмену приёма (вернул деньги или решил, что возврата нет)
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS cancellation_handled_at TIMESTAMP;
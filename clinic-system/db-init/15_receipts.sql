@@ -0,0 +1,34 @@
+-- Старые таблицы transactions/receipts не использовались ни одним сервисом:
+-- платежи живут в payments, чеки теперь привязаны к ним
+DROP TABLE IF EXISTS receipts;
+DROP TABLE IF EXISTS transactions;
+
+-- Ставка НДС клиники в процентах; медицинские услуги обычно не облагаются
+ALTER TABLE clinics ADD COLUMN IF NOT EXISTS tax_rate NUMERIC(5, 2) NOT NULL DEFAULT 0;
+
+-- Сквозная нумерация чеков в пределах клиники и года
+CREATE TABLE IF NOT EXISTS receipt_counters (
+    clinic_id INTEGER NOT NULL REFERENCES clinics(id),
+    year INTEGER NOT NULL,
+    last_number INTEGER NOT NULL,
+    PRIMARY KEY (clinic_id, year)
+);
+
+-- Чек фиксирует реквизиты клиники и суммы на момент оплаты и потом не меняется
+CREATE TABLE IF NOT EXISTS receipts (
+    id SERIAL PRIMARY KEY,
+    number VARCHAR(50) NOT NULL UNIQUE,
+    payment_id INTEGER NOT NULL UNIQUE REFERENCES payments(id),
+    clinic_id INTEGER NOT NULL REFERENCES clinics(id),
+    clinic_name VARCHAR(255) NOT NULL,
+    clinic_address VARCHAR(255) NOT NULL,
+    clinic_phone VARCHAR(20) NOT NULL,
+    payer_name VARCHAR(255),
+    service VARCHAR(100) NOT NULL,
+    description TEXT,
+    amount_minor BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    tax_rate NUMERIC(5, 2) NOT NULL,
+    tax_amount_minor BIGINT NOT NULL,
+    issued_at TIMESTAMP DEFAULT NOW()
+);
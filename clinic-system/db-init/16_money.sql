@@ -0,0 +1,5 @@
+-- Валюта клиники (ISO 4217): в ней заданы цены и проводятся платежи.
+-- Суммы везде хранятся целыми минорными единицами (копейки, центы),
+-- чтобы сервисы нигде не работали с деньгами через float.
+ALTER TABLE clinics ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'RUB'
+    CHECK (currency ~ '^[A-Z]{3}$');
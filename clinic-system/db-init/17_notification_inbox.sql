@@ -0,0 +1,4 @@
+-- Входящие уведомления: когда пользователь прочитал уведомление (NULL — не прочитано)
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS read_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
@@ -0,0 +1,20 @@
+-- Доставка уведомлений по каналам: очередь с повторами.
+-- Уже существующие уведомления считаем доставленными, новые попадают в очередь.
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'sent';
+ALTER TABLE notifications ALTER COLUMN status SET DEFAULT 'queued';
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS created_at TIMESTAMP;
+UPDATE notifications SET created_at = COALESCE(sent_at, NOW()) WHERE created_at IS NULL;
+ALTER TABLE notifications ALTER COLUMN created_at SET DEFAULT NOW();
+ALTER TABLE notifications ALTER COLUMN created_at SET NOT NULL;
+
+-- sent_at теперь — время фактической отправки, у ещё не отправленных NULL
+ALTER TABLE notifications ALTER COLUMN sent_at DROP DEFAULT;
+
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW();
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS last_error TEXT;
+
+CREATE INDEX IF NOT EXISTS notifications_queue_idx ON notifications (next_attempt_at) WHERE status = 'queued';
+
+-- Входящие сортируются по времени создания
+CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, created_at DESC, id DESC);
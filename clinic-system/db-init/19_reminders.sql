@@ -0,0 +1,27 @@
+-- Настройки уведомлений пользователя. Нет строки — действуют значения по умолчанию.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id),
+    inbox BOOLEAN NOT NULL DEFAULT true,
+    email BOOLEAN NOT NULL DEFAULT true,
+    sms BOOLEAN NOT NULL DEFAULT false,
+    push BOOLEAN NOT NULL DEFAULT false,
+    -- За сколько минут до приёма напоминать; пустой массив — не напоминать
+    reminder_offsets INTEGER[] NOT NULL DEFAULT '{1440,120}',
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Запланированные напоминания о приёмах. slot_start — время приёма на момент
+-- планирования: если приём перенесли, старые напоминания отменяются и создаются новые.
+CREATE TABLE IF NOT EXISTS appointment_reminders (
+    id SERIAL PRIMARY KEY,
+    appointment_id INTEGER NOT NULL REFERENCES appointments(id),
+    offset_minutes INTEGER NOT NULL,
+    channel VARCHAR(50) NOT NULL,
+    slot_start TIMESTAMP NOT NULL,
+    send_at TIMESTAMP NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'scheduled', -- scheduled, sent, cancelled, expired, failed
+    notification_id INTEGER REFERENCES notifications(id),
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE (appointment_id, offset_minutes, channel, slot_start)
+);
+CREATE INDEX IF NOT EXISTS appointment_reminders_due_idx ON appointment_reminders (send_at) WHERE status = 'scheduled';
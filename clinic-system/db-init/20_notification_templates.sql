@@ -0,0 +1,20 @@
+-- Переопределения шаблонов уведомлений. Встроенные тексты живут в коде сервиса;
+-- строка с clinic_id IS NULL меняет шаблон для всей системы, с clinic_id — для одной клиники.
+CREATE TABLE IF NOT EXISTS notification_templates (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    language VARCHAR(5) NOT NULL,
+    clinic_id INTEGER REFERENCES clinics(id),
+    subject TEXT NOT NULL DEFAULT '',
+    body TEXT NOT NULL,
+    updated_by INTEGER REFERENCES users(id),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS notification_templates_key_idx
+    ON notification_templates (name, language, COALESCE(clinic_id, 0));
+
+-- Тема письма уведомления (для email)
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS subject TEXT;
+
+-- Язык, на котором пользователь получает уведомления
+ALTER TABLE notification_preferences ADD COLUMN IF NOT EXISTS language VARCHAR(5) NOT NULL DEFAULT 'ru';
@@ -0,0 +1,46 @@
+-- Доменные события между сервисами (transactional outbox), см. пакет eventbus
+CREATE TABLE IF NOT EXISTS events (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- Кто на что подписан. Подписчик регистрирует свои темы при запуске;
+-- известные подписки заведены заранее, чтобы события, опубликованные
+-- до первого запуска подписчика, не потерялись.
+CREATE TABLE IF NOT EXISTS event_subscriptions (
+    consumer VARCHAR(100) NOT NULL,
+    topic VARCHAR(100) NOT NULL,
+    PRIMARY KEY (consumer, topic)
+);
+INSERT INTO event_subscriptions (consumer, topic) VALUES
+    ('notifications', 'appointment.booked'),
+    ('notifications', 'appointment.cancelled'),
+    ('notifications', 'receipt.issued'),
+    ('payments', 'appointment.cancelled'),
+    ('payments', 'payment.succeeded')
+ON CONFLICT DO NOTHING;
+
+-- Очередь доставки: строка на каждую пару подписчик–событие
+CREATE TABLE IF NOT EXISTS event_deliveries (
+    consumer VARCHAR(100) NOT NULL,
+    event_id BIGINT NOT NULL REFERENCES events(id),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    delivered_at TIMESTAMP,
+    -- Доставка, не обработанная за все попытки, больше не повторяется.
+    -- Чтобы запустить её снова, обнулите failed_at и attempts.
+    failed_at TIMESTAMP,
+    PRIMARY KEY (consumer, event_id)
+);
+CREATE INDEX IF NOT EXISTS event_deliveries_pending_idx
+    ON event_deliveries (consumer, next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
+CREATE INDEX IF NOT EXISTS event_deliveries_failed_idx
+    ON event_deliveries (consumer, failed_at) WHERE failed_at IS NOT NULL;
+
+-- Уведомление, созданное по событию, не дублируется при повторной доставке
+ALTER TABLE notifications ADD COLUMN IF NOT EXISTS event_id BIGINT REFERENCES events(id);
+CREATE UNIQUE INDEX IF NOT EXISTS notifications_event_idx
+    ON notifications (event_id, user_id, channel) WHERE event_id IS NOT NULL;
@@ -0,0 +1,30 @@
+-- Живые обновления для клиентов: о новых уведомлениях и событиях приёмов
+-- база сообщает через NOTIFY user_stream, сервис уведомлений рассылает их
+-- подключённым клиентам (GET /notify/stream). Полезная нагрузка NOTIFY
+-- ограничена 8000 байт, поэтому передаётся только id уведомления или
+-- события: данные сервис читает из базы сам.
+CREATE OR REPLACE FUNCTION notify_user_stream_notification() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('user_stream', json_build_object(
+        'user_id', NEW.user_id, 'type', 'notification', 'id', NEW.id)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS notifications_user_stream ON notifications;
+CREATE TRIGGER notifications_user_stream AFTER INSERT ON notifications
+    FOR EACH ROW EXECUTE FUNCTION notify_user_stream_notification();
+
+CREATE OR REPLACE FUNCTION notify_user_stream_event() RETURNS trigger AS $$
+BEGIN
+    IF NEW.topic LIKE 'appointment.%' AND NEW.payload ? 'patient_id' THEN
+        PERFORM pg_notify('user_stream', json_build_object(
+            'user_id', (NEW.payload->>'patient_id')::INTEGER, 'type', NEW.topic, 'id', NEW.id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS events_user_stream ON events;
+CREATE TRIGGER events_user_stream AFTER INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION notify_user_stream_event();
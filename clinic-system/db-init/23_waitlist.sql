@@ -0,0 +1,46 @@
+-- Лист ожидания: пациент ждёт освободившийся слот врача в окне дат
+CREATE TABLE IF NOT EXISTS waitlist_entries (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    doctor_id INTEGER NOT NULL REFERENCES doctors(id),
+    date_from DATE NOT NULL,
+    date_to DATE NOT NULL CHECK (date_to >= date_from),
+    -- waiting, offered (держит слот), booked, cancelled, expired (окно прошло)
+    status VARCHAR(20) NOT NULL DEFAULT 'waiting',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+-- Одна активная заявка пациента к врачу
+CREATE UNIQUE INDEX IF NOT EXISTS waitlist_entries_active_idx
+    ON waitlist_entries (user_id, doctor_id) WHERE status IN ('waiting', 'offered');
+CREATE INDEX IF NOT EXISTS waitlist_entries_queue_idx
+    ON waitlist_entries (doctor_id, created_at, id) WHERE status = 'waiting';
+
+-- Бронь освободившегося слота для пациента из листа ожидания. Пока бронь
+-- активна, слот не свободен; по истечении он предлагается следующему.
+CREATE TABLE IF NOT EXISTS slot_holds (
+    id SERIAL PRIMARY KEY,
+    slot_id INTEGER NOT NULL REFERENCES schedule_slots(id),
+    waitlist_id INTEGER NOT NULL REFERENCES waitlist_entries(id),
+    expires_at TIMESTAMP NOT NULL,
+    -- active, accepted, declined, expired
+    status VARCHAR(20) NOT NULL DEFAULT 'active',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS slot_holds_active_idx ON slot_holds (slot_id) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS slot_holds_expiry_idx ON slot_holds (expires_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS slot_holds_waitlist_idx ON slot_holds (waitlist_id);
+
+INSERT INTO event_subscriptions (consumer, topic) VALUES ('notifications', 'waitlist.offered')
+ON CONFLICT DO NOTHING;
+
+-- Предложения слота тоже уходят в живой поток пациента
+CREATE OR REPLACE FUNCTION notify_user_stream_event() RETURNS trigger AS $$
+BEGIN
+    IF (NEW.topic LIKE 'appointment.%' OR NEW.topic LIKE 'waitlist.%') AND NEW.payload ? 'patient_id' THEN
+        PERFORM pg_notify('user_stream', json_build_object(
+            'user_id', (NEW.payload->>'patient_id')::INTEGER, 'type', NEW.topic, 'id', NEW.id)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,17 @@
+-- История изменений приёма: переносы (и другие действия, если понадобятся)
+CREATE TABLE IF NOT EXISTS appointment_history (
+    id SERIAL PRIMARY KEY,
+    appointment_id INTEGER NOT NULL REFERENCES appointments(id),
+    action VARCHAR(30) NOT NULL, -- rescheduled
+    old_slot_id INTEGER REFERENCES schedule_slots(id),
+    new_slot_id INTEGER REFERENCES schedule_slots(id),
+    old_start TIMESTAMP,
+    new_start TIMESTAMP,
+    changed_by INTEGER REFERENCES users(id),
+    reason TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS appointment_history_appointment_idx ON appointment_history (appointment_id, id);
+
+INSERT INTO event_subscriptions (consumer, topic) VALUES ('notifications', 'appointment.rescheduled')
+ON CONFLICT DO NOTHING;
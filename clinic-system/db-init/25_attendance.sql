@@ -0,0 +1,13 @@
+-- Правила отмены и неявок клиники
+ALTER TABLE clinics ADD COLUMN IF NOT EXISTS cancellation_cutoff_hours INTEGER NOT NULL DEFAULT 24
+    CHECK (cancellation_cutoff_hours >= 0);
+-- false — позже срока пациент отменить не может, true — может, но отмена считается поздней
+ALTER TABLE clinics ADD COLUMN IF NOT EXISTS late_cancellation_allowed BOOLEAN NOT NULL DEFAULT true;
+-- Сколько неявок за no_show_window_days закрывают пациенту запись в клинику; NULL — без ограничения
+ALTER TABLE clinics ADD COLUMN IF NOT EXISTS no_show_limit INTEGER CHECK (no_show_limit > 0);
+ALTER TABLE clinics ADD COLUMN IF NOT EXISTS no_show_window_days INTEGER NOT NULL DEFAULT 180
+    CHECK (no_show_window_days > 0);
+
+-- Отмена пациентом позже срока клиники
+ALTER TABLE appointments ADD COLUMN IF NOT EXISTS cancelled_late BOOLEAN NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS appointments_user_status_idx ON appointments (user_id, status);
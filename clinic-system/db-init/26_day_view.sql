@@ -0,0 +1,4 @@
+-- Индексы для дневного расписания клиники (GET /dashboard/day)
+CREATE INDEX IF NOT EXISTS schedule_slots_doctor_start_idx ON schedule_slots (doctor_id, start_time);
+CREATE INDEX IF NOT EXISTS appointments_slot_idx ON appointments (slot_id);
+CREATE INDEX IF NOT EXISTS doctors_clinic_idx ON doctors (clinic_id);
@@ -0,0 +1,4 @@
+-- Индексы для статистики по всем клиникам (GET /stats)
+CREATE INDEX IF NOT EXISTS schedule_slots_start_idx ON schedule_slots (start_time);
+CREATE INDEX IF NOT EXISTS payments_date_idx ON payments (payment_date);
+CREATE INDEX IF NOT EXISTS payment_refunds_created_idx ON payment_refunds (created_at);
@@ -0,0 +1,165 @@
+package eventbus
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Consumer получает события подписанных тем. Несколько экземпляров сервиса
+// с одним именем делят доставки между собой (SKIP LOCKED), разные имена
+// получают каждое событие независимо. Доставка, не обработанная за
+// MaxAttempts попыток, получает failed_at и больше не повторяется.
+type Consumer struct {
+	db       *sql.DB
+	dsn      string
+	name     string
+	handlers map[string]Handler
+
+	PollInterval time.Duration // опрос на случай пропущенного NOTIFY
+	Batch        int
+	Retry
+}
+
+// NewConsumer создаёт подписчика name. dsn нужен для отдельного
+// соединения LISTEN.
+func NewConsumer(db *sql.DB, dsn, name string) *Consumer {
+	return &Consumer{
+		db:           db,
+		dsn:          dsn,
+		name:         name,
+		handlers:     map[string]Handler{},
+		PollInterval: 10 * time.Second,
+		Batch:        50,
+		Retry: Retry{
+			MaxAttempts: 12,
+			BaseBackoff: 5 * time.Second,
+			MaxBackoff:  30 * time.Minute,
+			Lease:       5 * time.Minute,
+		},
+	}
+}
+
+// Handle подписывает на тему. Вызывать до Run.
+func (c *Consumer) Handle(topic string, h Handler) {
+	c.handlers[topic] = h
+}
+
+// subscribe сохраняет подписки: с этого момента Publish ставит события
+// в очередь этому подписчику, даже если он сейчас не запущен
+func (c *Consumer) subscribe(ctx context.Context) error {
+	topics := make([]string, 0, len(c.handlers))
+	for t := range c.handlers {
+		topics = append(topics, t)
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO event_subscriptions (consumer, topic)
+		SELECT $1, unnest($2::TEXT[])
+		ON CONFLICT DO NOTHING`, c.name, pq.Array(topics))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM event_subscriptions WHERE consumer = $1 AND NOT topic = ANY($2)`, c.name, pq.Array(topics))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// claim берёт пачку доставок, которые пора обработать
+func (c *Consumer) claim(ctx context.Context) ([]Event, error) {
+	rows, err := c.db.QueryContext(ctx, `
+		UPDATE event_deliveries d
+		SET attempts = d.attempts + 1,
+		    next_attempt_at = NOW() + make_interval(secs => $3)
+		FROM (
+			SELECT consumer, event_id FROM event_deliveries
+			WHERE consumer = $1 AND delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+			ORDER BY event_id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		) due, events e
+		WHERE d.consumer = due.consumer AND d.event_id = due.event_id AND e.id = d.event_id
+		RETURNING e.id, e.topic, e.payload, e.created_at, d.attempts`,
+		c.name, c.Batch, c.Lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Event
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.ID, &ev.Topic, &ev.Payload, &ev.CreatedAt, &ev.Attempt); err != nil {
+			return nil, err
+		}
+		list = append(list, ev)
+	}
+	return list, rows.Err()
+}
+
+func (c *Consumer) process(ctx context.Context, ev Event) {
+	var err error
+	// Темы, от которых подписчик отказался, просто отмечаются доставленными
+	if h, ok := c.handlers[ev.Topic]; ok {
+		err = h(ctx, ev)
+	}
+
+	switch {
+	case err == nil:
+		_, err = c.db.ExecContext(ctx, `
+			UPDATE event_deliveries SET delivered_at = NOW(), last_error = NULL
+			WHERE consumer = $1 AND event_id = $2`, c.name, ev.ID)
+	case c.Exhausted(ev.Attempt):
+		log.Printf("%s: событие %d (%s) не обработано за %d попыток: %v", c.name, ev.ID, ev.Topic, ev.Attempt, err)
+		_, err = c.db.ExecContext(ctx, `
+			UPDATE event_deliveries SET last_error = $3, failed_at = NOW()
+			WHERE consumer = $1 AND event_id = $2`, c.name, ev.ID, err.Error())
+	default:
+		wait := c.Backoff(ev.Attempt)
+		log.Printf("%s: событие %d (%s), попытка %d: %v; повтор через %s", c.name, ev.ID, ev.Topic, ev.Attempt, err, wait)
+		_, err = c.db.ExecContext(ctx, `
+			UPDATE event_deliveries SET last_error = $3, next_attempt_at = NOW() + make_interval(secs => $4)
+			WHERE consumer = $1 AND event_id = $2`, c.name, ev.ID, err.Error(), wait.Seconds())
+	}
+	if err != nil {
+		log.Printf("%s: событие %d: не удалось сохранить результат: %v", c.name, ev.ID, err)
+	}
+}
+
+// Run подписывается и обрабатывает события, пока не отменён ctx
+func (c *Consumer) Run(ctx context.Context) error {
+	if err := c.subscribe(ctx); err != nil {
+		return err
+	}
+
+	listener := pq.NewListener(c.dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("%s: LISTEN: %v", c.name, err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(notifyChannel); err != nil {
+		return err
+	}
+
+	return Poll(ctx, c.PollInterval, listener.Notify, func(ctx context.Context) bool {
+		batch, err := c.claim(ctx)
+		if err != nil {
+			log.Printf("%s: очередь событий: %v", c.name, err)
+		}
+		for _, ev := range batch {
+			c.process(ctx, ev)
+		}
+		return len(batch) == c.Batch
+	})
+}
@@ -0,0 +1,114 @@
+// Package eventbus — доменные события между сервисами через общую базу.
+//
+// Публикация — transactional outbox: событие пишется в таблицу events в той же
+// транзакции, что и изменение данных, поэтому оно появляется тогда и только
+// тогда, когда изменение зафиксировано. Для каждого подписчика создаётся строка
+// в event_deliveries; Consumer забирает свои доставки, будится через
+// LISTEN/NOTIFY и повторяет неудачные с экспоненциальной задержкой, пока не
+// кончатся попытки (Retry).
+// Доставка «хотя бы один раз» — обработчики должны быть идемпотентными.
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Темы событий
+const (
+	AppointmentBooked      = "appointment.booked"
+	AppointmentCancelled   = "appointment.cancelled"
+	AppointmentRescheduled = "appointment.rescheduled"
+	AppointmentCompleted   = "appointment.completed"
+	AppointmentNoShow      = "appointment.no_show"
+	PaymentSucceeded       = "payment.succeeded"
+	PaymentRefunded        = "payment.refunded"
+	ReceiptIssued          = "receipt.issued"
+	UserRegistered         = "user.registered"
+	WaitlistOffered        = "waitlist.offered"
+)
+
+// notifyChannel — канал LISTEN/NOTIFY, которым будятся подписчики
+const notifyChannel = "events"
+
+// Appointment — полезная нагрузка appointment.*
+type Appointment struct {
+	AppointmentID int       `json:"appointment_id"`
+	PatientID     int       `json:"patient_id"`
+	SlotID        int       `json:"slot_id"`
+	DoctorID      int       `json:"doctor_id"`
+	ClinicID      int       `json:"clinic_id"`
+	Start         time.Time `json:"start"`
+	CancelledBy   *int      `json:"cancelled_by,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	// Прежний слот — только appointment.rescheduled
+	PreviousSlotID *int       `json:"previous_slot_id,omitempty"`
+	PreviousStart  *time.Time `json:"previous_start,omitempty"`
+}
+
+// Payment — полезная нагрузка payment.*; суммы в минорных единицах валюты
+type Payment struct {
+	PaymentID     int    `json:"payment_id"`
+	AppointmentID int    `json:"appointment_id"`
+	AmountMinor   int64  `json:"amount_minor"`
+	Currency      string `json:"currency"`
+	Status        string `json:"status"`
+	// RefundMinor — сумма конкретного возврата (только payment.refunded)
+	RefundMinor int64 `json:"refund_minor,omitempty"`
+}
+
+// Receipt — полезная нагрузка receipt.issued
+type Receipt struct {
+	ReceiptID   int       `json:"receipt_id"`
+	Number      string    `json:"number"`
+	PaymentID   int       `json:"payment_id"`
+	PatientID   int       `json:"patient_id"`
+	ClinicID    int       `json:"clinic_id"`
+	AmountMinor int64     `json:"amount_minor"`
+	Amount      string    `json:"amount"` // десятичная запись для текстов
+	Currency    string    `json:"currency"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// WaitlistOffer — полезная нагрузка waitlist.offered: слот придержан для
+// пациента из листа ожидания до ExpiresAt
+type WaitlistOffer struct {
+	WaitlistID int       `json:"waitlist_id"`
+	HoldID     int       `json:"hold_id"`
+	PatientID  int       `json:"patient_id"`
+	SlotID     int       `json:"slot_id"`
+	DoctorID   int       `json:"doctor_id"`
+	ClinicID   int       `json:"clinic_id"`
+	Start      time.Time `json:"start"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// User — полезная нагрузка user.*
+type User struct {
+	UserID   int    `json:"user_id"`
+	Role     string `json:"role"`
+	ClinicID *int   `json:"clinic_id,omitempty"`
+}
+
+// Event — событие, как его получает обработчик
+type Event struct {
+	ID        int64
+	Topic     string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	// Attempt — номер попытки доставки этому подписчику, начиная с 1
+	Attempt int
+}
+
+// Decode разбирает полезную нагрузку в v
+func (e Event) Decode(v any) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("событие %d (%s): %w", e.ID, e.Topic, err)
+	}
+	return nil
+}
+
+// Handler обрабатывает событие. Ошибка — доставка будет повторена позже.
+type Handler func(ctx context.Context, ev Event) error
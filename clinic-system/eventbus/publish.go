@@ -0,0 +1,37 @@
+package eventbus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// Tx — *sql.Tx (или *sql.DB, если атомарность с изменением данных не нужна)
+type Tx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Publish записывает событие в outbox и ставит его в очередь всем подписчикам
+// темы. Вызывается внутри транзакции, меняющей данные: если транзакция
+// откатится, события не будет. NOTIFY тоже уходит только при фиксации.
+func Publish(ctx context.Context, tx Tx, topic string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO events (topic, payload) VALUES ($1, $2) RETURNING id`, topic, body).Scan(&id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO event_deliveries (consumer, event_id)
+		SELECT consumer, $2 FROM event_subscriptions WHERE topic = $1`, topic, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, notifyChannel, topic)
+	return err
+}
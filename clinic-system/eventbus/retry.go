@@ -0,0 +1,50 @@
+package eventbus
+
+import (
+	"context"
+	"time"
+)
+
+// Retry — правила повторов для очередей в таблицах БД: взятая в работу
+// строка откладывается на Lease, неудачная попытка — с экспоненциальной
+// задержкой, после MaxAttempts попыток строка помечается неудавшейся.
+// Общие для Consumer и очередей сервисов (например, рассылки уведомлений).
+type Retry struct {
+	MaxAttempts int // 0 — без ограничения
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Lease — на сколько откладывается взятая в работу строка: если процесс
+	// упадёт посреди обработки, после Lease её заберут снова
+	Lease time.Duration
+}
+
+// Backoff — задержка перед следующей попыткой после attempt неудачных
+func (r Retry) Backoff(attempt int) time.Duration {
+	wait := r.BaseBackoff
+	for i := 1; i < attempt && wait < r.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, r.MaxBackoff)
+}
+
+// Exhausted — попытки кончились, повторять больше не нужно
+func (r Retry) Exhausted(attempt int) bool {
+	return r.MaxAttempts > 0 && attempt >= r.MaxAttempts
+}
+
+// Poll вызывает step, пока тот обрабатывает полные пачки (full == true),
+// затем ждёт сигнала wake или interval. Возвращается при отмене ctx.
+// wake может быть nil — тогда очередь только опрашивается.
+func Poll[T any](ctx context.Context, interval time.Duration, wake <-chan T, step func(context.Context) (full bool)) error {
+	for {
+		if step(ctx) {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtSecret — JWT_SECRET, тот же ключ, которым подписывает токены сервис users.
+// Задаётся в main; без него gateway не запускается.
+var jwtSecret []byte
+
+var errBadToken = errors.New("недействительный токен")
+
+// bearerToken берёт токен из Authorization: Bearer или из ?access_token=
+// (EventSource в браузере не умеет задавать заголовки)
+func bearerToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return c.Query("access_token")
+}
+
+// userFromToken проверяет JWT и возвращает user_id
+func userFromToken(tokenStr string) (int, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (any, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return 0, errBadToken
+	}
+	id, ok := claims["user_id"].(float64)
+	if !ok || id <= 0 {
+		return 0, errBadToken
+	}
+	return int(id), nil
+}
+
+// identify определяет пользователя по JWT и подставляет X-User-ID из него.
+// Присланный клиентом X-User-ID никогда не доходит до сервисов: без токена
+// запрос уходит анонимным, и сервис сам ответит 401, если нужен пользователь.
+// С недействительным токеном gateway сам отвечает 401 и возвращает false.
+func identify(c *gin.Context) bool {
+	c.Request.Header.Del("X-User-ID")
+	tokenStr := bearerToken(c)
+	if tokenStr == "" {
+		return true
+	}
+	id, err := userFromToken(tokenStr)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return false
+	}
+	c.Request.Header.Set("X-User-ID", strconv.Itoa(id))
+	// Токен дальше gateway не уходит, в том числе в журналы сервисов
+	c.Request.Header.Del("Authorization")
+	q := c.Request.URL.Query()
+	q.Del("access_token")
+	c.Request.URL.RawQuery = q.Encode()
+	return true
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gin-gonic/gin"
 )
 
 func proxy(c *gin.Context, target string) {
+	if !identify(c) {
+		return
+	}
 	client := &http.Client{}
-	req, err := http.NewRequest(c.Request.Method, target, c.Request.Body)
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	// тело передаём потоком, без чтения в память — важно для загрузки файлов
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, target, c.Request.Body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка проксирования"})
 		return
 	}
 	// копируем заголовки
 	req.Header = c.Request.Header
+	req.ContentLength = c.Request.ContentLength
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -34,13 +44,49 @@ func proxy(c *gin.Context, target string) {
 		}
 	}
 
+	// Ответ без длины (потоки событий, chunked) отдаём клиенту по мере
+	// поступления, иначе он застрянет в буфере до конца ответа
+	if resp.ContentLength < 0 {
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+		if err := copyFlushing(c.Writer, resp.Body); err != nil {
+			log.Printf("проксирование %s: %v", target, err)
+		}
+		return
+	}
+
 	// копируем тело ответа
 	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка копирования данных"})
 	}
 }
 
+// copyFlushing копирует тело, сбрасывая каждый прочитанный кусок клиенту.
+// Закрытие соединения клиентом отменяет запрос к сервису через контекст.
+func copyFlushing(w gin.ResponseWriter, body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			w.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
 func main() {
+	if jwtSecret = []byte(os.Getenv("JWT_SECRET")); len(jwtSecret) == 0 {
+		log.Fatal("JWT_SECRET не задан")
+	}
+
 	r := gin.Default()
 
 	// users service
@@ -75,6 +121,12 @@ func main() {
 
 	// notifications service
 	r.Any("/api/notifications/*path", func(c *gin.Context) {
+		// Живой поток открывается из браузера напрямую: токен обязателен
+		// и может прийти в ?access_token=
+		if c.Param("path") == "/notify/stream" && bearerToken(c) == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": errBadToken.Error()})
+			return
+		}
 		target := "http://notifications:8086" + c.Param("path")
 		proxy(c, target)
 	})
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Attachment — файл, приложенный к записи медкарты
+type Attachment struct {
+	ID          int       `json:"id"`
+	RecordID    int       `json:"record_id"`
+	Kind        string    `json:"kind"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	SizeBytes   int64     `json:"size_bytes"`
+	UploadedBy  int       `json:"uploaded_by"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	storageKey string
+}
+
+// Виды вложений
+var attachmentKinds = map[string]bool{
+	"lab_result": true,
+	"scan":       true,
+	"referral":   true,
+	"other":      true,
+}
+
+// Разрешённые типы файлов и расширения, под которыми они хранятся.
+// Тип определяется по содержимому, заголовку клиента не доверяем.
+var attachmentTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+}
+
+var (
+	errAttachmentEmpty    = errors.New("файл пустой")
+	errAttachmentTooLarge = errors.New("файл слишком большой")
+	errAttachmentType     = errors.New("недопустимый тип файла: разрешены PDF, JPEG, PNG и WebP")
+)
+
+// maxAttachmentSize — лимит из ATTACHMENT_MAX_MB, по умолчанию 20 МБ
+func maxAttachmentSize() int64 {
+	if mb, err := strconv.Atoi(os.Getenv("ATTACHMENT_MAX_MB")); err == nil && mb > 0 {
+		return int64(mb) << 20
+	}
+	return 20 << 20
+}
+
+// saveAttachment проверяет файл, кладёт его в хранилище и регистрирует в БД
+func saveAttachment(ctx context.Context, db *sql.DB, store Storage, a *Attachment, fh *multipart.FileHeader) error {
+	if fh.Size == 0 {
+		return errAttachmentEmpty
+	}
+	if fh.Size > maxAttachmentSize() {
+		return errAttachmentTooLarge
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	head = head[:n]
+
+	contentType := detectContentType(head)
+	ext, ok := attachmentTypes[contentType]
+	if !ok {
+		return errAttachmentType
+	}
+
+	a.ContentType = contentType
+	a.SizeBytes = fh.Size
+	a.FileName = filepath.Base(fh.Filename)
+	name, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	a.storageKey = fmt.Sprintf("records/%d/%s%s", a.RecordID, name, ext)
+
+	body := io.MultiReader(bytes.NewReader(head), f)
+	if err := store.Put(ctx, a.storageKey, body, a.SizeBytes, a.ContentType); err != nil {
+		return err
+	}
+
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO record_attachments (record_id, kind, file_name, content_type, size_bytes, storage_key, uploaded_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`,
+		a.RecordID, a.Kind, a.FileName, a.ContentType, a.SizeBytes, a.storageKey, a.UploadedBy).
+		Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		// Файл без строки в БД никому не виден — убираем его
+		_ = store.Delete(context.Background(), a.storageKey)
+		return err
+	}
+	return nil
+}
+
+// detectContentType определяет тип файла по сигнатуре в первых байтах
+func detectContentType(head []byte) string {
+	if len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP" {
+		return "image/webp"
+	}
+	if bytes.HasPrefix(head, []byte("%PDF-")) {
+		return "application/pdf"
+	}
+	if bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}) {
+		return "image/jpeg"
+	}
+	if bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")) {
+		return "image/png"
+	}
+	return "application/octet-stream"
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func listAttachments(db *sql.DB, recordID int) ([]Attachment, error) {
+	rows, err := db.Query(`
+		SELECT id, record_id, kind, file_name, content_type, size_bytes, uploaded_by, created_at
+		FROM record_attachments
+		WHERE record_id = $1
+		ORDER BY created_at, id`, recordID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.RecordID, &a.Kind, &a.FileName, &a.ContentType, &a.SizeBytes, &a.UploadedBy, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func loadAttachment(db *sql.DB, recordID, attachmentID int) (*Attachment, error) {
+	var a Attachment
+	err := db.QueryRow(`
+		SELECT id, record_id, kind, file_name, content_type, size_bytes, uploaded_by, created_at, storage_key
+		FROM record_attachments
+		WHERE id = $1 AND record_id = $2`, attachmentID, recordID).
+		Scan(&a.ID, &a.RecordID, &a.Kind, &a.FileName, &a.ContentType, &a.SizeBytes, &a.UploadedBy, &a.CreatedAt, &a.storageKey)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func deleteAttachment(ctx context.Context, db *sql.DB, store Storage, a *Attachment) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM record_attachments WHERE id = $1`, a.ID); err != nil {
+		return err
+	}
+	return store.Delete(ctx, a.storageKey)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Роли пользователей из таблицы users
+const (
+	rolePatient     = "patient"
+	roleDoctor      = "doctor"
+	roleClinicAdmin = "clinic_admin"
+	roleAdmin       = "admin"
+)
+
+// caller — пользователь, от имени которого пришёл запрос (X-User-ID gateway берёт из JWT)
+type caller struct {
+	ID       int
+	Role     string
+	ClinicID *int
+}
+
+var errNoCaller = errors.New("не указан X-User-ID")
+
+func loadCaller(db *sql.DB, c *gin.Context) (*caller, error) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil {
+		return nil, errNoCaller
+	}
+	u := caller{ID: id}
+	err = db.QueryRow(`SELECT role, clinic_id FROM users WHERE id = $1`, id).Scan(&u.Role, &u.ClinicID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoCaller
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// isClinicStaff — врач или администратор той клиники, где проходил приём
+func (u *caller) isClinicStaff(clinicID int) bool {
+	return (u.Role == roleDoctor || u.Role == roleClinicAdmin) && u.ClinicID != nil && *u.ClinicID == clinicID
+}
+
+// recordOwner — кому принадлежит запись медкарты и в какой клинике она сделана
+type recordOwner struct {
+	PatientID int
+	ClinicID  int
+}
+
+func loadRecordOwner(db *sql.DB, recordID int) (*recordOwner, error) {
+	var o recordOwner
+	err := db.QueryRow(`
+		SELECT m.patient_id, d.clinic_id
+		FROM medical_records m
+		JOIN doctors d ON d.id = m.doctor_id
+		WHERE m.id = $1`, recordID).Scan(&o.PatientID, &o.ClinicID)
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// canRead — пациент видит свои записи, персонал — записи своей клиники
+func (u *caller) canRead(o *recordOwner) bool {
+	return u.Role == roleAdmin || u.ID == o.PatientID || u.isClinicStaff(o.ClinicID)
+}
+
+// canWrite — дополнять запись может только персонал клиники
+func (u *caller) canWrite(o *recordOwner) bool {
+	return u.Role == roleAdmin || u.isClinicStaff(o.ClinicID)
+}
+
+// authorizeRecord проверяет доступ к записи из параметра :id.
+// При отказе сам отвечает клиенту и возвращает ok == false.
+func authorizeRecord(db *sql.DB, c *gin.Context, write bool) (u *caller, recordID int, ok bool) {
+	recordID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID записи"})
+		return nil, 0, false
+	}
+	u, err = loadCaller(db, c)
+	if errors.Is(err, errNoCaller) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+		return nil, 0, false
+	}
+	owner, err := loadRecordOwner(db, recordID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "запись не найдена"})
+		return nil, 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+		return nil, 0, false
+	}
+	if (write && !u.canWrite(owner)) || (!write && !u.canRead(owner)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "нет доступа к записи"})
+		return nil, 0, false
+	}
+	return u, recordID, true
+}
+
+// authorizePatient определяет, чью медкарту смотрят: ?patient_id или свою.
+// Пациент и администратор системы видят все записи, персонал — только
+// записи своей клиники (clinicID != nil). При отказе сам отвечает клиенту.
+func authorizePatient(db *sql.DB, c *gin.Context) (patientID int, clinicID *int, ok bool) {
+	u, err := loadCaller(db, c)
+	if errors.Is(err, errNoCaller) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return 0, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+		return 0, nil, false
+	}
+
+	patientID = u.ID
+	if s := c.Query("patient_id"); s != "" {
+		if patientID, err = strconv.Atoi(s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный patient_id"})
+			return 0, nil, false
+		}
+	}
+	switch {
+	case patientID == u.ID || u.Role == roleAdmin:
+		return patientID, nil, true
+	case (u.Role == roleDoctor || u.Role == roleClinicAdmin) && u.ClinicID != nil:
+		return patientID, u.ClinicID, true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "нет доступа к медкарте пациента"})
+	return 0, nil, false
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Diagnosis — диагноз по коду МКБ-10
+type Diagnosis struct {
+	Code      string `json:"code"`
+	Title     string `json:"title,omitempty"`
+	IsPrimary bool   `json:"is_primary"`
+	Note      string `json:"note,omitempty"`
+}
+
+// Prescription — назначение препарата
+type Prescription struct {
+	Drug         string `json:"drug"`
+	Dose         string `json:"dose"`
+	Frequency    string `json:"frequency"`
+	DurationDays *int   `json:"duration_days,omitempty"`
+	Notes        string `json:"notes,omitempty"`
+}
+
+// Vitals — показатели, снятые на приёме. Все поля необязательные.
+type Vitals struct {
+	Systolic    *int     `json:"systolic,omitempty"`
+	Diastolic   *int     `json:"diastolic,omitempty"`
+	Pulse       *int     `json:"pulse,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Weight      *float64 `json:"weight,omitempty"`
+}
+
+// VitalsPoint — точка временного ряда показателей для графиков
+type VitalsPoint struct {
+	RecordID  int       `json:"record_id"`
+	VisitDate time.Time `json:"visit_date"`
+	Vitals
+}
+
+func (rec *MedicalRecord) validateClinical() error {
+	primary := 0
+	for i, d := range rec.Diagnoses {
+		rec.Diagnoses[i].Code = strings.ToUpper(strings.TrimSpace(d.Code))
+		if rec.Diagnoses[i].Code == "" {
+			return fmt.Errorf("у диагноза не указан код МКБ-10")
+		}
+		if d.IsPrimary {
+			primary++
+		}
+	}
+	if primary > 1 {
+		return fmt.Errorf("основной диагноз может быть только один")
+	}
+
+	for _, p := range rec.Prescriptions {
+		if strings.TrimSpace(p.Drug) == "" || strings.TrimSpace(p.Dose) == "" || strings.TrimSpace(p.Frequency) == "" {
+			return fmt.Errorf("в назначении обязательны препарат, доза и кратность")
+		}
+		if p.DurationDays != nil && *p.DurationDays <= 0 {
+			return fmt.Errorf("длительность курса должна быть положительной")
+		}
+	}
+
+	if v := rec.Vitals; v != nil {
+		if !intInRange(v.Systolic, 50, 300) || !intInRange(v.Diastolic, 30, 200) {
+			return fmt.Errorf("некорректное давление")
+		}
+		if v.Systolic != nil && v.Diastolic != nil && *v.Diastolic >= *v.Systolic {
+			return fmt.Errorf("диастолическое давление должно быть ниже систолического")
+		}
+		if !intInRange(v.Pulse, 20, 300) {
+			return fmt.Errorf("некорректный пульс")
+		}
+		if !floatInRange(v.Temperature, 30, 45) {
+			return fmt.Errorf("некорректная температура")
+		}
+		if !floatInRange(v.Weight, 0.5, 500) {
+			return fmt.Errorf("некорректный вес")
+		}
+	}
+	return nil
+}
+
+func intInRange(v *int, min, max int) bool {
+	return v == nil || (*v >= min && *v <= max)
+}
+
+func floatInRange(v *float64, min, max float64) bool {
+	return v == nil || (*v >= min && *v <= max)
+}
+
+// saveClinical сохраняет диагнозы, назначения и показатели записи в рамках транзакции
+func saveClinical(tx *sql.Tx, rec *MedicalRecord) error {
+	for _, d := range rec.Diagnoses {
+		if _, err := tx.Exec(`
+			INSERT INTO record_diagnoses (record_id, icd10_code, is_primary, note)
+			VALUES ($1, $2, $3, $4)`,
+			rec.ID, d.Code, d.IsPrimary, d.Note); err != nil {
+			return err
+		}
+	}
+	for _, p := range rec.Prescriptions {
+		if _, err := tx.Exec(`
+			INSERT INTO prescriptions (record_id, drug, dose, frequency, duration_days, notes)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			rec.ID, p.Drug, p.Dose, p.Frequency, p.DurationDays, p.Notes); err != nil {
+			return err
+		}
+	}
+	if v := rec.Vitals; v != nil {
+		if _, err := tx.Exec(`
+			INSERT INTO vitals (record_id, systolic, diastolic, pulse, temperature, weight)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			rec.ID, v.Systolic, v.Diastolic, v.Pulse, v.Temperature, v.Weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadClinical подгружает структурированные данные для списка записей
+// тремя запросами вместо трёх на каждую запись
+func loadClinical(db *sql.DB, records []MedicalRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(records))
+	byID := make(map[int]*MedicalRecord, len(records))
+	for i := range records {
+		ids[i] = int64(records[i].ID)
+		byID[records[i].ID] = &records[i]
+	}
+
+	rows, err := db.Query(`
+		SELECT d.record_id, d.icd10_code, c.title, d.is_primary, COALESCE(d.note, '')
+		FROM record_diagnoses d
+		JOIN icd10_codes c ON c.code = d.icd10_code
+		WHERE d.record_id = ANY($1)
+		ORDER BY d.is_primary DESC, d.id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var d Diagnosis
+		if err := rows.Scan(&id, &d.Code, &d.Title, &d.IsPrimary, &d.Note); err != nil {
+			rows.Close()
+			return err
+		}
+		byID[id].Diagnoses = append(byID[id].Diagnoses, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`
+		SELECT record_id, drug, dose, frequency, duration_days, COALESCE(notes, '')
+		FROM prescriptions
+		WHERE record_id = ANY($1)
+		ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var p Prescription
+		if err := rows.Scan(&id, &p.Drug, &p.Dose, &p.Frequency, &p.DurationDays, &p.Notes); err != nil {
+			rows.Close()
+			return err
+		}
+		byID[id].Prescriptions = append(byID[id].Prescriptions, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(`
+		SELECT record_id, systolic, diastolic, pulse, temperature, weight
+		FROM vitals
+		WHERE record_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var v Vitals
+		if err := rows.Scan(&id, &v.Systolic, &v.Diastolic, &v.Pulse, &v.Temperature, &v.Weight); err != nil {
+			return err
+		}
+		byID[id].Vitals = &v
+	}
+	return rows.Err()
+}
+
+// loadVitalsHistory возвращает показатели пациента по датам визитов;
+// clinicID != nil — только по записям этой клиники
+func loadVitalsHistory(db *sql.DB, patientID int, clinicID *int) ([]VitalsPoint, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.visit_date, v.systolic, v.diastolic, v.pulse, v.temperature, v.weight
+		FROM vitals v
+		JOIN medical_records m ON m.id = v.record_id
+		JOIN doctors d ON d.id = m.doctor_id
+		WHERE m.patient_id = $1 AND ($2::INTEGER IS NULL OR d.clinic_id = $2)
+		ORDER BY m.visit_date, m.id`, patientID, clinicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []VitalsPoint{}
+	for rows.Next() {
+		var p VitalsPoint
+		if err := rows.Scan(&p.RecordID, &p.VisitDate, &p.Systolic, &p.Diastolic, &p.Pulse, &p.Temperature, &p.Weight); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Шифрование полей медкарты по схеме envelope encryption:
+// текст шифруется ключом данных (DEK), а DEK хранится в таблице data_keys
+// зашифрованным мастер-ключом. Мастер-ключ в БД не попадает.
+//
+// Зашифрованное значение хранится в той же TEXT-колонке как
+// "enc:v1:<id ключа данных>:<base64(nonce|шифртекст)>". Шифртекст привязан
+// к полю и id записи (AAD "поле:id"), поэтому его нельзя перенести в другую
+// запись. Значения без префикса — старые записи в открытом виде; они и записи
+// под неактуальным DEK перешифровываются при чтении.
+
+const encPrefix = "enc:v1:"
+
+// fieldAAD привязывает шифртекст к полю и записи
+func fieldAAD(field string, recordID int) []byte {
+	return []byte(field + ":" + strconv.Itoa(recordID))
+}
+
+// fieldCipher шифрует и расшифровывает чувствительные поля
+type fieldCipher struct {
+	db           *sql.DB
+	masters      map[string][]byte
+	activeMaster string
+
+	mu      sync.RWMutex
+	keys    map[int][]byte // расшифрованные DEK по id
+	current int
+}
+
+// loadMasterKeys читает мастер-ключи из MASTER_KEYS или файла MASTER_KEYS_FILE.
+// Формат: "id:base64" через запятую или по строке; первый ключ — активный,
+// остальные нужны только чтобы развернуть DEK, обёрнутые до ротации.
+func loadMasterKeys() (map[string][]byte, string, error) {
+	raw := os.Getenv("MASTER_KEYS")
+	if path := os.Getenv("MASTER_KEYS_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		raw = string(b)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil, "", errors.New("не заданы MASTER_KEYS или MASTER_KEYS_FILE")
+	}
+
+	keys := map[string][]byte{}
+	active := ""
+	for _, item := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == '\n' }) {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+		id, b64, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return nil, "", fmt.Errorf("мастер-ключ %q: ожидается формат id:base64", item)
+		}
+		key, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(key) != 32 {
+			return nil, "", fmt.Errorf("мастер-ключ %q: нужно 32 байта в base64", id)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, "", fmt.Errorf("мастер-ключ %q указан дважды", id)
+		}
+		keys[id] = key
+		if active == "" {
+			active = id
+		}
+	}
+	return keys, active, nil
+}
+
+func newFieldCipherFromEnv(db *sql.DB) (*fieldCipher, error) {
+	masters, active, err := loadMasterKeys()
+	if err != nil {
+		return nil, err
+	}
+	fc := &fieldCipher{db: db, masters: masters, activeMaster: active, keys: map[int][]byte{}}
+	if err := fc.loadDataKeys(); err != nil {
+		return nil, err
+	}
+	if fc.current == 0 {
+		if _, err := fc.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return fc, nil
+}
+
+// loadDataKeys разворачивает все DEK и переобёртывает те, что зашифрованы
+// не активным мастер-ключом, — так ротация мастер-ключа не трогает сами данные.
+// Запись в БД идёт без блокировки fc.mu: сюда же приходит Decrypt.
+func (fc *fieldCipher) loadDataKeys() error {
+	rows, err := fc.db.Query(`SELECT id, master_key_id, wrapped_key FROM data_keys ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type wrapped struct {
+		id       int
+		masterID string
+		key      []byte
+	}
+	var list []wrapped
+	for rows.Next() {
+		var w wrapped
+		if err := rows.Scan(&w.id, &w.masterID, &w.key); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	keys := make(map[int][]byte, len(list))
+	for _, w := range list {
+		master, ok := fc.masters[w.masterID]
+		if !ok {
+			return fmt.Errorf("ключ данных %d обёрнут неизвестным мастер-ключом %q", w.id, w.masterID)
+		}
+		dek, err := gcmOpen(master, w.key, []byte("dek:"+w.masterID))
+		if err != nil {
+			return fmt.Errorf("ключ данных %d: %w", w.id, err)
+		}
+		if w.masterID != fc.activeMaster {
+			rewrapped, err := gcmSeal(fc.masters[fc.activeMaster], dek, []byte("dek:"+fc.activeMaster))
+			if err != nil {
+				return err
+			}
+			// Условие на старый мастер-ключ: другой экземпляр мог успеть первым
+			if _, err := fc.db.Exec(`
+				UPDATE data_keys SET master_key_id = $2, wrapped_key = $3
+				WHERE id = $1 AND master_key_id = $4`,
+				w.id, fc.activeMaster, rewrapped, w.masterID); err != nil {
+				return err
+			}
+			log.Printf("Ключ данных %d переобёрнут мастер-ключом %q", w.id, fc.activeMaster)
+		}
+		keys[w.id] = dek
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for id, dek := range keys {
+		fc.keys[id] = dek
+		if id > fc.current {
+			fc.current = id
+		}
+	}
+	return nil
+}
+
+// Rotate создаёт новый ключ данных и делает его текущим.
+// Старые значения перешифровываются лениво, при следующем чтении.
+func (fc *fieldCipher) Rotate() (int, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return 0, err
+	}
+	wrapped, err := gcmSeal(fc.masters[fc.activeMaster], dek, []byte("dek:"+fc.activeMaster))
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = fc.db.QueryRow(`INSERT INTO data_keys (master_key_id, wrapped_key) VALUES ($1, $2) RETURNING id`,
+		fc.activeMaster, wrapped).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	fc.mu.Lock()
+	fc.keys[id] = dek
+	fc.current = id
+	fc.mu.Unlock()
+	return id, nil
+}
+
+// Encrypt шифрует значение поля записи recordID текущим ключом данных.
+// Пустая строка остаётся пустой.
+func (fc *fieldCipher) Encrypt(field string, recordID int, plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	fc.mu.RLock()
+	id, dek := fc.current, fc.keys[fc.current]
+	fc.mu.RUnlock()
+
+	sealed, err := gcmSeal(dek, []byte(plain), fieldAAD(field, recordID))
+	if err != nil {
+		return "", err
+	}
+	return encPrefix + strconv.Itoa(id) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt возвращает открытый текст и признак stale — значение нужно
+// перешифровать (хранится открытым текстом или под старым ключом данных)
+func (fc *fieldCipher) Decrypt(field string, recordID int, stored string) (plain string, stale bool, err error) {
+	if stored == "" {
+		return "", false, nil
+	}
+	rest, found := strings.CutPrefix(stored, encPrefix)
+	if !found {
+		return stored, true, nil
+	}
+	idStr, b64, ok := strings.Cut(rest, ":")
+	id, err := strconv.Atoi(idStr)
+	if !ok || err != nil {
+		return "", false, errors.New("повреждённое зашифрованное значение")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return "", false, errors.New("повреждённое зашифрованное значение")
+	}
+
+	dek, current, known := fc.dataKey(id)
+	if !known {
+		// Ключ мог создать другой экземпляр сервиса после нашего старта
+		if err := fc.loadDataKeys(); err != nil {
+			return "", false, err
+		}
+		if dek, current, known = fc.dataKey(id); !known {
+			return "", false, fmt.Errorf("неизвестный ключ данных %d", id)
+		}
+	}
+
+	b, err := gcmOpen(dek, sealed, fieldAAD(field, recordID))
+	if err != nil {
+		return "", false, err
+	}
+	return string(b), id != current, nil
+}
+
+func (fc *fieldCipher) dataKey(id int) (dek []byte, current int, ok bool) {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	dek, ok = fc.keys[id]
+	return dek, fc.current, ok
+}
+
+// openRecord расшифровывает диагноз и лечение записи на месте и при
+// необходимости перешифровывает их в БД текущим ключом
+func (fc *fieldCipher) openRecord(rec *MedicalRecord) error {
+	storedDiagnosis, storedTreatment := rec.Diagnosis, rec.Treatment
+
+	diagnosis, staleD, err := fc.Decrypt("diagnosis", rec.ID, storedDiagnosis)
+	if err != nil {
+		return fmt.Errorf("запись %d, диагноз: %w", rec.ID, err)
+	}
+	treatment, staleT, err := fc.Decrypt("treatment", rec.ID, storedTreatment)
+	if err != nil {
+		return fmt.Errorf("запись %d, лечение: %w", rec.ID, err)
+	}
+	rec.Diagnosis, rec.Treatment = diagnosis, treatment
+
+	if staleD || staleT {
+		if err := fc.reseal(rec.ID, diagnosis, treatment, storedDiagnosis, storedTreatment); err != nil {
+			// Не мешаем чтению: попробуем в следующий раз
+			log.Printf("перешифрование записи %d: %v", rec.ID, err)
+		}
+	}
+	return nil
+}
+
+// reseal перезаписывает поля, только если их никто не изменил с момента чтения
+func (fc *fieldCipher) reseal(id int, diagnosis, treatment, oldDiagnosis, oldTreatment string) error {
+	encDiagnosis, err := fc.Encrypt("diagnosis", id, diagnosis)
+	if err != nil {
+		return err
+	}
+	encTreatment, err := fc.Encrypt("treatment", id, treatment)
+	if err != nil {
+		return err
+	}
+	_, err = fc.db.Exec(`
+		UPDATE medical_records SET diagnosis = $2, treatment = $3
+		WHERE id = $1 AND COALESCE(diagnosis, '') = $4 AND COALESCE(treatment, '') = $5`,
+		id, encDiagnosis, encTreatment, oldDiagnosis, oldTreatment)
+	return err
+}
+
+func gcmSeal(key, plain, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func gcmOpen(key, sealed, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("шифртекст слишком короткий")
+	}
+	nonce, ct := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, errors.New("не удалось расшифровать: неверный ключ или данные повреждены")
+	}
+	return plain, nil
+}
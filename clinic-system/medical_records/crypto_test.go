@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+// testCipher — fieldCipher без БД с одним ключом данных id 1
+func testCipher() *fieldCipher {
+	return &fieldCipher{
+		masters:      map[string][]byte{"m1": testKey(1)},
+		activeMaster: "m1",
+		keys:         map[int][]byte{1: testKey(10)},
+		current:      1,
+	}
+}
+
+func TestFieldCipherRoundTrip(t *testing.T) {
+	fc := testCipher()
+	for _, plain := range []string{"", "J06.9 ОРВИ", strings.Repeat("длинный текст ", 500)} {
+		enc, err := fc.Encrypt("diagnosis", 42, plain)
+		if err != nil {
+			t.Fatalf("Encrypt(%q): %v", plain, err)
+		}
+		if plain == "" {
+			if enc != "" {
+				t.Errorf("пустое значение зашифровано в %q", enc)
+			}
+			continue
+		}
+		if !strings.HasPrefix(enc, encPrefix+"1:") || strings.Contains(enc, plain) {
+			t.Errorf("Encrypt(%q) = %q", plain, enc)
+		}
+		got, stale, err := fc.Decrypt("diagnosis", 42, enc)
+		if err != nil || got != plain || stale {
+			t.Errorf("Decrypt = %q, stale %v, %v; ожидалось %q", got, stale, err, plain)
+		}
+	}
+}
+
+func TestFieldCipherBoundToFieldAndRecord(t *testing.T) {
+	fc := testCipher()
+	enc, err := fc.Encrypt("diagnosis", 42, "J06.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fc.Decrypt("diagnosis", 43, enc); err == nil {
+		t.Error("шифртекст расшифровался в другой записи")
+	}
+	if _, _, err := fc.Decrypt("treatment", 42, enc); err == nil {
+		t.Error("шифртекст расшифровался в другом поле")
+	}
+}
+
+func TestFieldCipherStale(t *testing.T) {
+	fc := testCipher()
+	old, err := fc.Encrypt("treatment", 7, "покой")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ротация: появился ключ 2, он текущий
+	fc.keys[2], fc.current = testKey(20), 2
+	fresh, err := fc.Encrypt("treatment", 7, "покой")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		stored string
+		stale  bool
+	}{
+		{"под старым ключом", old, true},
+		{"под текущим ключом", fresh, false},
+		{"открытый текст", "покой", true},
+	}
+	for _, tt := range tests {
+		got, stale, err := fc.Decrypt("treatment", 7, tt.stored)
+		if err != nil || got != "покой" || stale != tt.stale {
+			t.Errorf("%s: Decrypt = %q, stale %v, %v; ожидалось stale %v", tt.name, got, stale, err, tt.stale)
+		}
+	}
+}
+
+func TestFieldCipherCorrupted(t *testing.T) {
+	fc := testCipher()
+	enc, err := fc.Encrypt("diagnosis", 1, "J06.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc, encPrefix+"1:"))
+	raw[len(raw)-1] ^= 1
+	for _, stored := range []string{
+		encPrefix + "1:" + base64.StdEncoding.EncodeToString(raw), // подменён байт
+		encPrefix + "x:AAAA",        // не число вместо id ключа
+		encPrefix + "1:не-base64",   // битый base64
+		encPrefix + "1:" + "AAAA",   // короче nonce
+		encPrefix + strconv.Itoa(1), // нет шифртекста
+	} {
+		if _, _, err := fc.Decrypt("diagnosis", 1, stored); err == nil {
+			t.Errorf("Decrypt(%q) без ошибки", stored)
+		}
+	}
+}
+
+func TestDataKeyWrap(t *testing.T) {
+	dek := testKey(10)
+	wrapped, err := gcmSeal(testKey(1), dek, []byte("dek:m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gcmOpen(testKey(1), wrapped, []byte("dek:m1"))
+	if err != nil || !bytes.Equal(got, dek) {
+		t.Errorf("развёртка DEK = %x, %v", got, err)
+	}
+	// DEK, обёрнутый одним мастер-ключом, не разворачивается другим
+	if _, err := gcmOpen(testKey(2), wrapped, []byte("dek:m1")); err == nil {
+		t.Error("DEK развернулся чужим мастер-ключом")
+	}
+	if _, err := gcmOpen(testKey(1), wrapped, []byte("dek:m2")); err == nil {
+		t.Error("DEK развернулся с чужим id мастер-ключа")
+	}
+}
+
+func TestLoadMasterKeys(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(testKey(1))
+	k2 := base64.StdEncoding.EncodeToString(testKey(2))
+	tests := []struct {
+		name   string
+		env    string
+		active string
+		n      int
+		ok     bool
+	}{
+		{"через запятую", "new:" + k2 + ",old:" + k1, "new", 2, true},
+		{"по строкам с комментарием", "# ключи\nold:" + k1 + "\n", "old", 1, true},
+		{"пусто", "  ", "", 0, false},
+		{"без id", ":" + k1, "", 0, false},
+		{"короткий ключ", "a:" + base64.StdEncoding.EncodeToString([]byte("short")), "", 0, false},
+		{"дубликат", "a:" + k1 + ",a:" + k2, "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("MASTER_KEYS_FILE", "")
+		t.Setenv("MASTER_KEYS", tt.env)
+		keys, active, err := loadMasterKeys()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: ошибка %v", tt.name, err)
+			continue
+		}
+		if tt.ok && (active != tt.active || len(keys) != tt.n) {
+			t.Errorf("%s: активный %q, ключей %d", tt.name, active, len(keys))
+		}
+	}
+}
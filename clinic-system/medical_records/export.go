@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// patientHistory — всё, что попадает в выгрузку медкарты
+type patientHistory struct {
+	PatientID int
+	FullName  string
+	Email     string
+	Phone     string
+	Visits    []historyVisit
+}
+
+// historyVisit — запись медкарты вместе с данными приёма, врача и клиники
+type historyVisit struct {
+	MedicalRecord
+	DoctorName    string
+	Specialty     string
+	ClinicName    string
+	ClinicAddress string
+	Start         time.Time
+	End           time.Time
+	Status        string
+}
+
+func loadPatientHistory(db *sql.DB, fc *fieldCipher, patientID int) (*patientHistory, error) {
+	h := patientHistory{PatientID: patientID}
+	err := db.QueryRow(`
+		SELECT COALESCE(full_name, ''), email, COALESCE(phone, '')
+		FROM users WHERE id = $1`, patientID).
+		Scan(&h.FullName, &h.Email, &h.Phone)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT m.id, m.patient_id, m.doctor_id, m.appointment_id,
+		       COALESCE(m.diagnosis, ''), COALESCE(m.treatment, ''), m.visit_date,
+		       COALESCE(d.full_name, ''), COALESCE(d.specialty, ''),
+		       COALESCE(cl.name, ''), COALESCE(cl.address, ''),
+		       s.start_time, s.end_time, a.status
+		FROM medical_records m
+		JOIN doctors d ON d.id = m.doctor_id
+		LEFT JOIN clinics cl ON cl.id = d.clinic_id
+		JOIN appointments a ON a.id = m.appointment_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		WHERE m.patient_id = $1
+		ORDER BY s.start_time, m.id`, patientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var v historyVisit
+		if err := rows.Scan(&v.ID, &v.PatientID, &v.DoctorID, &v.AppointmentID,
+			&v.Diagnosis, &v.Treatment, &v.VisitDate,
+			&v.DoctorName, &v.Specialty, &v.ClinicName, &v.ClinicAddress,
+			&v.Start, &v.End, &v.Status); err != nil {
+			return nil, err
+		}
+		if err := fc.openRecord(&v.MedicalRecord); err != nil {
+			return nil, err
+		}
+		h.Visits = append(h.Visits, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	records := make([]MedicalRecord, len(h.Visits))
+	for i := range h.Visits {
+		records[i] = h.Visits[i].MedicalRecord
+	}
+	if err := loadClinical(db, records); err != nil {
+		return nil, err
+	}
+	for i := range h.Visits {
+		h.Visits[i].MedicalRecord = records[i]
+	}
+	return &h, nil
+}
+
+// FHIR R4: минимальная обёртка Bundle, ресурсы собираются как map
+type fhirBundle struct {
+	ResourceType string      `json:"resourceType"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Timestamp    string      `json:"timestamp"`
+	Entry        []fhirEntry `json:"entry"`
+}
+
+type fhirEntry struct {
+	FullURL  string         `json:"fullUrl"`
+	Resource map[string]any `json:"resource"`
+}
+
+const (
+	fhirICD10System   = "http://hl7.org/fhir/sid/icd-10"
+	fhirActCodeSystem = "http://terminology.hl7.org/CodeSystem/v3-ActCode"
+	fhirCategorySys   = "http://terminology.hl7.org/CodeSystem/condition-category"
+)
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func fhirRef(url string) map[string]any {
+	return map[string]any{"reference": url}
+}
+
+// buildFHIRBundle собирает Bundle типа collection:
+// Patient, Practitioner, Encounter на каждый приём, Condition и MedicationRequest
+func buildFHIRBundle(h *patientHistory, now time.Time) (*fhirBundle, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	b := &fhirBundle{
+		ResourceType: "Bundle",
+		ID:           strings.TrimPrefix(id, "urn:uuid:"),
+		Type:         "collection",
+		Timestamp:    now.Format(time.RFC3339),
+	}
+	// Первая ошибка генерации id запоминается и возвращается в конце
+	add := func(res map[string]any) string {
+		url, uerr := newUUID()
+		if uerr != nil && err == nil {
+			err = uerr
+		}
+		b.Entry = append(b.Entry, fhirEntry{FullURL: url, Resource: res})
+		return url
+	}
+
+	var telecom []map[string]any
+	if h.Phone != "" {
+		telecom = append(telecom, map[string]any{"system": "phone", "value": h.Phone})
+	}
+	if h.Email != "" {
+		telecom = append(telecom, map[string]any{"system": "email", "value": h.Email})
+	}
+	patient := add(map[string]any{
+		"resourceType": "Patient",
+		"id":           fmt.Sprintf("patient-%d", h.PatientID),
+		"name":         []map[string]any{{"text": h.FullName}},
+		"telecom":      telecom,
+	})
+
+	practitioners := map[int]string{}
+	for _, v := range h.Visits {
+		if _, ok := practitioners[v.DoctorID]; ok {
+			continue
+		}
+		res := map[string]any{
+			"resourceType": "Practitioner",
+			"id":           fmt.Sprintf("doctor-%d", v.DoctorID),
+			"name":         []map[string]any{{"text": v.DoctorName}},
+		}
+		if v.Specialty != "" {
+			res["qualification"] = []map[string]any{{"code": map[string]any{"text": v.Specialty}}}
+		}
+		practitioners[v.DoctorID] = add(res)
+	}
+
+	for _, v := range h.Visits {
+		status := "finished"
+		if v.Status == statusInProgress {
+			status = "in-progress"
+		}
+		encounter := add(map[string]any{
+			"resourceType": "Encounter",
+			"id":           fmt.Sprintf("appointment-%d", v.AppointmentID),
+			"status":       status,
+			"class":        map[string]any{"system": fhirActCodeSystem, "code": "AMB", "display": "ambulatory"},
+			"subject":      fhirRef(patient),
+			"participant":  []map[string]any{{"individual": fhirRef(practitioners[v.DoctorID])}},
+			"period": map[string]any{
+				"start": v.Start.Format(time.RFC3339),
+				"end":   v.End.Format(time.RFC3339),
+			},
+			"serviceProvider": map[string]any{"display": v.ClinicName},
+		})
+
+		conditions := []map[string]any{}
+		for _, d := range v.Diagnoses {
+			code := map[string]any{
+				"coding": []map[string]any{{"system": fhirICD10System, "code": d.Code, "display": d.Title}},
+			}
+			if d.Note != "" {
+				code["text"] = d.Note
+			}
+			conditions = append(conditions, code)
+		}
+		// Свободный текст диагноза без кода тоже отдаём, чтобы ничего не потерять
+		if len(conditions) == 0 && v.Diagnosis != "" {
+			conditions = append(conditions, map[string]any{"text": v.Diagnosis})
+		}
+		for _, code := range conditions {
+			add(map[string]any{
+				"resourceType": "Condition",
+				"category": []map[string]any{{"coding": []map[string]any{{
+					"system": fhirCategorySys, "code": "encounter-diagnosis",
+				}}}},
+				"code":         code,
+				"subject":      fhirRef(patient),
+				"encounter":    fhirRef(encounter),
+				"recordedDate": v.VisitDate.Format("2006-01-02"),
+			})
+		}
+
+		for _, p := range v.Prescriptions {
+			res := map[string]any{
+				"resourceType":              "MedicationRequest",
+				"status":                    "completed",
+				"intent":                    "order",
+				"medicationCodeableConcept": map[string]any{"text": p.Drug},
+				"subject":                   fhirRef(patient),
+				"encounter":                 fhirRef(encounter),
+				"requester":                 fhirRef(practitioners[v.DoctorID]),
+				"authoredOn":                v.VisitDate.Format("2006-01-02"),
+				"dosageInstruction":         []map[string]any{{"text": p.Dose + ", " + p.Frequency}},
+			}
+			if p.DurationDays != nil {
+				res["dispenseRequest"] = map[string]any{"expectedSupplyDuration": map[string]any{
+					"value": *p.DurationDays, "unit": "d", "system": "http://unitsofmeasure.org", "code": "d",
+				}}
+			}
+			if p.Notes != "" {
+				res["note"] = []map[string]any{{"text": p.Notes}}
+			}
+			add(res)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// pdfFontPath — TTF с кириллицей; в образе ставится пакет fonts-dejavu-core
+func pdfFontPath() string {
+	if p := os.Getenv("PDF_FONT_PATH"); p != "" {
+		return p
+	}
+	return "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+}
+
+// writeHistoryPDF печатает читаемую выписку из медкарты
+func writeHistoryPDF(w io.Writer, h *patientHistory, now time.Time) error {
+	font, err := os.ReadFile(pdfFontPath())
+	if err != nil {
+		return fmt.Errorf("шрифт для PDF: %w", err)
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes("main", "", font)
+	pdf.SetMargins(15, 15, 15)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("main", "", 8)
+		pdf.CellFormat(0, 5, fmt.Sprintf("Стр. %d/{nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("main", "", 16)
+	pdf.CellFormat(0, 10, "Выписка из медицинской карты", "", 1, "L", false, 0, "")
+	pdf.SetFont("main", "", 10)
+	pdf.CellFormat(0, 6, "Пациент: "+h.FullName, "", 1, "L", false, 0, "")
+	if h.Phone != "" || h.Email != "" {
+		pdf.CellFormat(0, 6, "Контакты: "+strings.Trim(h.Phone+", "+h.Email, ", "), "", 1, "L", false, 0, "")
+	}
+	pdf.CellFormat(0, 6, "Дата выгрузки: "+now.Format("02.01.2006 15:04"), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	if len(h.Visits) == 0 {
+		pdf.CellFormat(0, 6, "Записей в медицинской карте нет.", "", 1, "L", false, 0, "")
+	}
+
+	for _, v := range h.Visits {
+		pdf.SetFont("main", "", 12)
+		pdf.CellFormat(0, 8, fmt.Sprintf("%s — %s", v.Start.Format("02.01.2006 15:04"), v.DoctorName), "B", 1, "L", false, 0, "")
+		pdf.SetFont("main", "", 10)
+		line := func(label, text string) {
+			if text == "" {
+				return
+			}
+			pdf.MultiCell(0, 5, label+": "+text, "", "L", false)
+		}
+		line("Специальность", v.Specialty)
+		line("Клиника", strings.Trim(v.ClinicName+", "+v.ClinicAddress, ", "))
+		for _, d := range v.Diagnoses {
+			text := d.Code + " " + d.Title
+			if d.IsPrimary {
+				text += " (основной)"
+			}
+			if d.Note != "" {
+				text += " — " + d.Note
+			}
+			line("Диагноз МКБ-10", text)
+		}
+		line("Заключение", v.Diagnosis)
+		line("Лечение", v.Treatment)
+		for _, p := range v.Prescriptions {
+			text := fmt.Sprintf("%s, %s, %s", p.Drug, p.Dose, p.Frequency)
+			if p.DurationDays != nil {
+				text += fmt.Sprintf(", %d дн.", *p.DurationDays)
+			}
+			if p.Notes != "" {
+				text += " — " + p.Notes
+			}
+			line("Назначение", text)
+		}
+		if v.Vitals != nil {
+			line("Показатели", formatVitals(v.Vitals))
+		}
+		pdf.Ln(3)
+	}
+
+	return pdf.Output(w)
+}
+
+func formatVitals(v *Vitals) string {
+	var parts []string
+	if v.Systolic != nil && v.Diastolic != nil {
+		parts = append(parts, fmt.Sprintf("АД %d/%d", *v.Systolic, *v.Diastolic))
+	}
+	if v.Pulse != nil {
+		parts = append(parts, fmt.Sprintf("пульс %d", *v.Pulse))
+	}
+	if v.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("t %.1f °C", *v.Temperature))
+	}
+	if v.Weight != nil {
+		parts = append(parts, fmt.Sprintf("вес %.1f кг", *v.Weight))
+	}
+	return strings.Join(parts, ", ")
+}
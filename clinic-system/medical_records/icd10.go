@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ICD10Code — запись справочника МКБ-10
+type ICD10Code struct {
+	Code  string `json:"code"`
+	Title string `json:"title"`
+}
+
+// importICD10 загружает справочник из CSV вида "код;название".
+// Существующие коды обновляются, поэтому файл можно грузить повторно.
+func importICD10(db *sql.DB, src io.Reader) (int, error) {
+	reader := csv.NewReader(src)
+	reader.Comma = ';'
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO icd10_codes (code, title) VALUES ($1, $2)
+		ON CONFLICT (code) DO UPDATE SET title = EXCLUDED.title`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("строка %d: %w", line, err)
+		}
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("строка %d: ожидается код и название", line)
+		}
+		code := strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(fields[0], "\ufeff")))
+		title := strings.TrimSpace(fields[1])
+		if line == 1 && strings.EqualFold(code, "code") {
+			continue // заголовок
+		}
+		if code == "" || title == "" || len(code) > 10 {
+			return 0, fmt.Errorf("строка %d: некорректная запись", line)
+		}
+		if _, err := stmt.Exec(code, title); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// importICD10File загружает справочник из файла, указанного в ICD10_PATH
+func importICD10File(db *sql.DB, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return importICD10(db, f)
+}
+
+// searchICD10 ищет коды по префиксу кода или подстроке названия.
+// Совпадения по коду идут первыми — так удобнее для автодополнения.
+func searchICD10(db *sql.DB, query string, limit int) ([]ICD10Code, error) {
+	query = strings.TrimSpace(query)
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query)
+
+	rows, err := db.Query(`
+		SELECT code, title
+		FROM icd10_codes
+		WHERE code LIKE upper($1) || '%' OR lower(title) LIKE '%' || lower($1) || '%'
+		ORDER BY (code LIKE upper($1) || '%') DESC, code
+		LIMIT $2`, escaped, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []ICD10Code{}
+	for rows.Next() {
+		var ic ICD10Code
+		if err := rows.Scan(&ic.Code, &ic.Title); err != nil {
+			return nil, err
+		}
+		codes = append(codes, ic)
+	}
+	return codes, rows.Err()
+}
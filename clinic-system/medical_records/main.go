@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type MedicalRecord struct {
@@ -20,6 +25,40 @@ type MedicalRecord struct {
 	Diagnosis     string    `json:"diagnosis"`
 	Treatment     string    `json:"treatment"`
 	VisitDate     time.Time `json:"visit_date"`
+
+	Diagnoses     []Diagnosis    `json:"diagnoses,omitempty"`
+	Prescriptions []Prescription `json:"prescriptions,omitempty"`
+	Vitals        *Vitals        `json:"vitals,omitempty"`
+}
+
+// Статусы приёма, при которых врач может вести медкарту
+const (
+	statusInProgress = "на приёме"
+	statusCompleted  = "завершён"
+)
+
+// visit — приём вместе с данными слота, по которому он был записан
+type visit struct {
+	PatientID int
+	DoctorID  int
+	ClinicID  int
+	Status    string
+	StartTime time.Time
+}
+
+func loadVisit(db *sql.DB, appointmentID int) (*visit, error) {
+	var v visit
+	err := db.QueryRow(`
+		SELECT a.user_id, s.doctor_id, d.clinic_id, a.status, s.start_time
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE a.id = $1`, appointmentID).
+		Scan(&v.PatientID, &v.DoctorID, &v.ClinicID, &v.Status, &v.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
 }
 
 func main() {
@@ -34,53 +73,149 @@ func main() {
 	}
 	defer db.Close()
 
+	if path := os.Getenv("ICD10_PATH"); path != "" {
+		n, err := importICD10File(db, path)
+		if err != nil {
+			log.Fatal("Не удалось загрузить справочник МКБ-10:", err)
+		}
+		log.Printf("Справочник МКБ-10 загружен: %d кодов", n)
+	}
+
+	fc, err := newFieldCipherFromEnv(db)
+	if err != nil {
+		log.Fatal("Не удалось инициализировать шифрование медкарт:", err)
+	}
+
+	store, err := newStorageFromEnv()
+	if err != nil {
+		log.Fatal("Не удалось инициализировать хранилище вложений:", err)
+	}
+
 	r := gin.Default()
 
 	// 1) Добавить запись в медицинскую карту
 	r.POST("/records", func(c *gin.Context) {
+		u, err := loadCaller(db, c)
+		if errors.Is(err, errNoCaller) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+			return
+		}
+		if u.Role != roleAdmin && u.Role != roleDoctor && u.Role != roleClinicAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "вести медкарту может только персонал клиники"})
+			return
+		}
+
 		var rec MedicalRecord
 		if err := c.BindJSON(&rec); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
 			return
 		}
+		if err := rec.validateClinical(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Сверяем запись с реальным приёмом, а не доверяем клиенту
+		v, err := loadVisit(db, rec.AppointmentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "приём не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке приёма"})
+			return
+		}
+		// Запись ведёт персонал клиники, где проходил приём
+		if u.Role != roleAdmin && !u.isClinicStaff(v.ClinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "нет доступа к приёму"})
+			return
+		}
+		if v.PatientID != rec.PatientID {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "приём принадлежит другому пациенту"})
+			return
+		}
+		if v.DoctorID != rec.DoctorID {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "приём проводил другой врач"})
+			return
+		}
+		if v.Status != statusInProgress && v.Status != statusCompleted {
+			c.JSON(http.StatusConflict, gin.H{"error": "приём ещё не начался или отменён"})
+			return
+		}
+		rec.VisitDate = v.StartTime
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при добавлении записи"})
+			return
+		}
+		defer tx.Rollback()
 
-		err := db.QueryRow(`
-			INSERT INTO medical_records (patient_id, doctor_id, appointment_id, diagnosis, treatment, visit_date)
-			VALUES ($1, $2, $3, $4, $5, $6)
+		// id нужен до вставки: шифртекст привязан к записи
+		if err := tx.QueryRow(`SELECT nextval(pg_get_serial_sequence('medical_records', 'id'))`).Scan(&rec.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при добавлении записи"})
+			return
+		}
+		encDiagnosis, err := fc.Encrypt("diagnosis", rec.ID, rec.Diagnosis)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка шифрования"})
+			return
+		}
+		encTreatment, err := fc.Encrypt("treatment", rec.ID, rec.Treatment)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка шифрования"})
+			return
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO medical_records (id, patient_id, doctor_id, appointment_id, diagnosis, treatment, visit_date)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (appointment_id) DO NOTHING
 			RETURNING id`,
-			rec.PatientID, rec.DoctorID, rec.AppointmentID, rec.Diagnosis, rec.Treatment, rec.VisitDate).
+			rec.ID, rec.PatientID, rec.DoctorID, rec.AppointmentID, encDiagnosis, encTreatment, rec.VisitDate).
 			Scan(&rec.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusConflict, gin.H{"error": "запись по этому приёму уже существует"})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при добавлении записи"})
 			return
 		}
-		c.JSON(http.StatusCreated, rec)
-	})
 
-	// 2) Получить список записей пациента
-	r.GET("/records", func(c *gin.Context) {
-		// Можно брать patient_id из заголовка X-User-ID (если пациент),
-		// или передавать query-параметр ?patient_id=...
-		patientIDStr := c.Query("patient_id")
-		if patientIDStr == "" {
-			patientIDStr = c.GetHeader("X-User-ID")
+		if err := saveClinical(tx, &rec); err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "неизвестный код МКБ-10"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при добавлении записи"})
+			return
 		}
-		if patientIDStr == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "не указан patient_id или X-User-ID"})
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при добавлении записи"})
 			return
 		}
+		c.JSON(http.StatusCreated, rec)
+	})
 
-		pid, err := strconv.Atoi(patientIDStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный patient_id"})
+	// 2) Получить список записей пациента
+	r.GET("/records", func(c *gin.Context) {
+		pid, clinicID, ok := authorizePatient(db, c)
+		if !ok {
 			return
 		}
 
 		rows, err := db.Query(`
-			SELECT id, patient_id, doctor_id, appointment_id, diagnosis, treatment, visit_date
-			FROM medical_records
-			WHERE patient_id = $1
-			ORDER BY visit_date DESC`, pid)
+			SELECT m.id, m.patient_id, m.doctor_id, m.appointment_id, m.diagnosis, m.treatment, m.visit_date
+			FROM medical_records m
+			JOIN doctors d ON d.id = m.doctor_id
+			WHERE m.patient_id = $1 AND ($2::INTEGER IS NULL OR d.clinic_id = $2)
+			ORDER BY m.visit_date DESC`, pid, clinicID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
 			return
@@ -90,13 +225,277 @@ func main() {
 		var records []MedicalRecord
 		for rows.Next() {
 			var r MedicalRecord
-			if err := rows.Scan(&r.ID, &r.PatientID, &r.DoctorID, &r.AppointmentID, &r.Diagnosis, &r.Treatment, &r.VisitDate); err == nil {
-				records = append(records, r)
+			if err := rows.Scan(&r.ID, &r.PatientID, &r.DoctorID, &r.AppointmentID, &r.Diagnosis, &r.Treatment, &r.VisitDate); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при чтении записей"})
+				return
+			}
+			records = append(records, r)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при чтении записей"})
+			return
+		}
+		for i := range records {
+			if err := fc.openRecord(&records[i]); err != nil {
+				log.Printf("расшифровка: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось расшифровать запись"})
+				return
 			}
 		}
+		if err := loadClinical(db, records); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
 		c.JSON(http.StatusOK, records)
 	})
 
+	// 3) Показатели пациента во времени — для графиков давления, пульса, веса
+	r.GET("/records/vitals", func(c *gin.Context) {
+		pid, clinicID, ok := authorizePatient(db, c)
+		if !ok {
+			return
+		}
+
+		points, err := loadVitalsHistory(db, pid, clinicID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+		c.JSON(http.StatusOK, points)
+	})
+
+	// Выгрузка всей медкарты пациента: ?format=fhir (по умолчанию) или ?format=pdf
+	r.GET("/records/export", func(c *gin.Context) {
+		u, err := loadCaller(db, c)
+		if errors.Is(err, errNoCaller) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+			return
+		}
+
+		pid := u.ID
+		if s := c.Query("patient_id"); s != "" {
+			if pid, err = strconv.Atoi(s); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "неверный patient_id"})
+				return
+			}
+		}
+		if pid != u.ID && u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "выгрузить можно только свою медкарту"})
+			return
+		}
+
+		h, err := loadPatientHistory(db, fc, pid)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "пациент не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+
+		now := time.Now()
+		switch c.DefaultQuery("format", "fhir") {
+		case "fhir":
+			bundle, err := buildFHIRBundle(h, now)
+			if err != nil {
+				log.Printf("FHIR-выгрузка медкарты пациента %d: %v", pid, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сформировать FHIR Bundle"})
+				return
+			}
+			body, err := json.Marshal(bundle)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сформировать FHIR Bundle"})
+				return
+			}
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="medical-history-%d.json"`, pid))
+			c.Data(http.StatusOK, "application/fhir+json", body)
+		case "pdf":
+			var buf bytes.Buffer
+			if err := writeHistoryPDF(&buf, h, now); err != nil {
+				log.Printf("PDF медкарты пациента %d: %v", pid, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сформировать PDF"})
+				return
+			}
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="medical-history-%d.pdf"`, pid))
+			c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format должен быть fhir или pdf"})
+		}
+	})
+
+	// 4) Поиск по справочнику МКБ-10 (автодополнение)
+	r.GET("/icd10", func(c *gin.Context) {
+		q := c.Query("q")
+		if q == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "не указан параметр q"})
+			return
+		}
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if err != nil || limit < 1 || limit > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit должен быть от 1 до 100"})
+			return
+		}
+
+		codes, err := searchICD10(db, q, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при поиске по справочнику"})
+			return
+		}
+		c.JSON(http.StatusOK, codes)
+	})
+
+	// 5) Загрузить справочник МКБ-10 (тело запроса — CSV "код;название")
+	r.POST("/icd10/import", func(c *gin.Context) {
+		u, err := loadCaller(db, c)
+		if err != nil || u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "доступно только администратору системы"})
+			return
+		}
+		n, err := importICD10(db, c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "не удалось загрузить справочник: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"imported": n})
+	})
+
+	// Ротация ключа данных: новые записи шифруются новым ключом,
+	// старые перешифровываются при чтении
+	r.POST("/admin/keys/rotate", func(c *gin.Context) {
+		u, err := loadCaller(db, c)
+		if err != nil || u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "доступно только администратору системы"})
+			return
+		}
+		id, err := fc.Rotate()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось создать ключ"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data_key_id": id})
+	})
+
+	// 6) Приложить файл к записи (multipart: file, kind)
+	r.POST("/records/:id/attachments", func(c *gin.Context) {
+		u, recordID, ok := authorizeRecord(db, c, true)
+		if !ok {
+			return
+		}
+
+		// Запас на служебные части multipart сверх лимита на сам файл
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize()+1<<20)
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "не передан файл или он слишком большой"})
+			return
+		}
+		kind := c.DefaultPostForm("kind", "other")
+		if !attachmentKinds[kind] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "kind должен быть lab_result, scan, referral или other"})
+			return
+		}
+
+		a := Attachment{RecordID: recordID, Kind: kind, UploadedBy: u.ID}
+		err = saveAttachment(c.Request.Context(), db, store, &a, fh)
+		switch {
+		case errors.Is(err, errAttachmentEmpty):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, errAttachmentTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, errAttachmentType):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		case err != nil:
+			log.Printf("загрузка вложения к записи %d: %v", recordID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сохранить файл"})
+		default:
+			c.JSON(http.StatusCreated, a)
+		}
+	})
+
+	// 7) Список вложений записи
+	r.GET("/records/:id/attachments", func(c *gin.Context) {
+		_, recordID, ok := authorizeRecord(db, c, false)
+		if !ok {
+			return
+		}
+		list, err := listAttachments(db, recordID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	// 8) Скачать вложение (отдаётся потоком, без загрузки в память)
+	r.GET("/records/:id/attachments/:aid", func(c *gin.Context) {
+		_, recordID, ok := authorizeRecord(db, c, false)
+		if !ok {
+			return
+		}
+		aid, err := strconv.Atoi(c.Param("aid"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID вложения"})
+			return
+		}
+		a, err := loadAttachment(db, recordID, aid)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "вложение не найдено"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+
+		body, err := store.Get(c.Request.Context(), a.storageKey)
+		if errors.Is(err, errObjectNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "файл отсутствует в хранилище"})
+			return
+		}
+		if err != nil {
+			log.Printf("чтение вложения %d: %v", a.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось прочитать файл"})
+			return
+		}
+		defer body.Close()
+
+		c.DataFromReader(http.StatusOK, a.SizeBytes, a.ContentType, body, map[string]string{
+			"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName}),
+		})
+	})
+
+	// 9) Удалить вложение
+	r.DELETE("/records/:id/attachments/:aid", func(c *gin.Context) {
+		_, recordID, ok := authorizeRecord(db, c, true)
+		if !ok {
+			return
+		}
+		aid, err := strconv.Atoi(c.Param("aid"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID вложения"})
+			return
+		}
+		a, err := loadAttachment(db, recordID, aid)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "вложение не найдено"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+		if err := deleteAttachment(c.Request.Context(), db, store, a); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось удалить вложение"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
 	if err := r.Run(":8084"); err != nil {
 		log.Fatal("Ошибка запуска medical_records сервиса:", err)
 	}
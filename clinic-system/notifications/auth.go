@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Роли пользователей из таблицы users
+const (
+	roleDoctor      = "doctor"
+	roleClinicAdmin = "clinic_admin"
+	roleAdmin       = "admin"
+)
+
+// caller — пользователь, от имени которого пришёл запрос (X-User-ID gateway берёт из JWT)
+type caller struct {
+	ID       int
+	Role     string
+	ClinicID *int
+}
+
+var errNoCaller = errors.New("не указан X-User-ID")
+
+// requireUser находит пользователя по X-User-ID. При ошибке сам отвечает клиенту.
+func requireUser(db *sql.DB, c *gin.Context) (*caller, bool) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errNoCaller.Error()})
+		return nil, false
+	}
+	u := caller{ID: id}
+	var role sql.NullString
+	err = db.QueryRow(`SELECT role, clinic_id FROM users WHERE id = $1`, id).Scan(&role, &u.ClinicID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errNoCaller.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+		return nil, false
+	}
+	u.Role = role.String
+	return &u, true
+}
+
+// requireCaller — requireUser, когда нужен только ID
+func requireCaller(db *sql.DB, c *gin.Context) (int, bool) {
+	u, ok := requireUser(db, c)
+	if !ok {
+		return 0, false
+	}
+	return u.ID, true
+}
+
+// managesClinic — администратор этой клиники или администратор системы.
+// clinicID == nil — общие настройки системы, их меняет только администратор системы.
+func (u *caller) managesClinic(clinicID *int) bool {
+	if u.Role == roleAdmin {
+		return true
+	}
+	return clinicID != nil && u.Role == roleClinicAdmin && u.ClinicID != nil && *u.ClinicID == *clinicID
+}
+
+// canNotify — администратор системы пишет кому угодно, врачи и администраторы
+// клиники — сотрудникам клиники и пациентам, записанным к её врачам
+func (u *caller) canNotify(db *sql.DB, userID int) (bool, error) {
+	if u.Role == roleAdmin {
+		return true, nil
+	}
+	if (u.Role != roleDoctor && u.Role != roleClinicAdmin) || u.ClinicID == nil {
+		return false, nil
+	}
+	var ok bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE id = $1 AND clinic_id = $2)
+		    OR EXISTS (
+		       SELECT 1 FROM appointments a
+		       JOIN schedule_slots s ON s.id = a.slot_id
+		       JOIN doctors d ON d.id = s.doctor_id
+		       WHERE a.user_id = $1 AND d.clinic_id = $2)`, userID, *u.ClinicID).Scan(&ok)
+	return ok, err
+}
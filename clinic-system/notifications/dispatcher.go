@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"eventbus"
+)
+
+// dispatcher забирает уведомления из очереди (status = queued, подошло
+// next_attempt_at) и отправляет их через Sender своего канала. Повторы —
+// по тем же правилам, что у событий (eventbus.Retry): неудачная попытка
+// откладывается с экспоненциальной задержкой, после MaxAttempts уведомление
+// помечается failed.
+type dispatcher struct {
+	db      *sql.DB
+	senders map[string]Sender
+
+	Interval time.Duration // как часто проверять очередь
+	Batch    int
+	eventbus.Retry
+}
+
+func newDispatcherFromEnv(db *sql.DB, senders map[string]Sender) *dispatcher {
+	d := &dispatcher{
+		db:       db,
+		senders:  senders,
+		Interval: 2 * time.Second,
+		Batch:    20,
+		Retry: eventbus.Retry{
+			MaxAttempts: 5,
+			BaseBackoff: 30 * time.Second,
+			MaxBackoff:  time.Hour,
+			Lease:       5 * time.Minute,
+		},
+	}
+	if n, err := strconv.Atoi(os.Getenv("NOTIFY_MAX_ATTEMPTS")); err == nil && n > 0 {
+		d.MaxAttempts = n
+	}
+	if sec, err := strconv.Atoi(os.Getenv("NOTIFY_BACKOFF_SECONDS")); err == nil && sec > 0 {
+		d.BaseBackoff = time.Duration(sec) * time.Second
+	}
+	return d
+}
+
+// queued — уведомление, взятое в работу, вместе с адресами получателя
+type queued struct {
+	ID       int
+	UserID   int
+	Channel  string
+	Subject  string
+	Body     string
+	Attempts int
+	Email    string
+	Phone    string
+}
+
+func (q queued) message() Message {
+	msg := Message{NotificationID: q.ID, UserID: q.UserID, Subject: q.Subject, Body: q.Body}
+	switch q.Channel {
+	case channelEmail:
+		msg.To = q.Email
+	case channelSMS:
+		msg.To = q.Phone
+	default:
+		msg.To = strconv.Itoa(q.UserID)
+	}
+	return msg
+}
+
+// claim берёт пачку готовых к отправке уведомлений. SKIP LOCKED позволяет
+// запускать несколько экземпляров сервиса без двойной отправки.
+func (d *dispatcher) claim(ctx context.Context) ([]queued, error) {
+	rows, err := d.db.QueryContext(ctx, `
+		UPDATE notifications n
+		SET attempts = n.attempts + 1,
+		    next_attempt_at = NOW() + make_interval(secs => $3)
+		FROM (
+			SELECT id FROM notifications
+			WHERE status = $1 AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		) due, users u
+		WHERE n.id = due.id AND u.id = n.user_id
+		RETURNING n.id, n.user_id, n.channel, COALESCE(n.subject, ''), COALESCE(n.message, ''), n.attempts,
+		          COALESCE(u.email, ''), COALESCE(u.phone, '')`,
+		statusQueued, d.Batch, d.Lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []queued
+	for rows.Next() {
+		var q queued
+		if err := rows.Scan(&q.ID, &q.UserID, &q.Channel, &q.Subject, &q.Body, &q.Attempts, &q.Email, &q.Phone); err != nil {
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, rows.Err()
+}
+
+func (d *dispatcher) deliver(ctx context.Context, q queued) {
+	var err error
+	if s, ok := d.senders[q.Channel]; ok {
+		sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err = s.Send(sendCtx, q.message())
+		cancel()
+	} else {
+		err = permanent("неизвестный канал %q", q.Channel)
+	}
+
+	switch {
+	case err == nil:
+		_, err = d.db.ExecContext(ctx, `
+			UPDATE notifications SET status = $2, sent_at = NOW(), last_error = NULL
+			WHERE id = $1`, q.ID, statusSent)
+	case errors.Is(err, errPermanent) || d.Exhausted(q.Attempts):
+		log.Printf("уведомление %d не доставлено (попытка %d): %v", q.ID, q.Attempts, err)
+		_, err = d.db.ExecContext(ctx, `
+			UPDATE notifications SET status = $2, last_error = $3
+			WHERE id = $1`, q.ID, statusFailed, err.Error())
+	default:
+		wait := d.Backoff(q.Attempts)
+		log.Printf("уведомление %d: попытка %d не удалась, повтор через %s: %v", q.ID, q.Attempts, wait, err)
+		_, err = d.db.ExecContext(ctx, `
+			UPDATE notifications SET last_error = $2, next_attempt_at = NOW() + make_interval(secs => $3)
+			WHERE id = $1`, q.ID, err.Error(), wait.Seconds())
+	}
+	if err != nil {
+		log.Printf("уведомление %d: не удалось сохранить результат: %v", q.ID, err)
+	}
+}
+
+// run обрабатывает очередь, пока не отменён ctx
+func (d *dispatcher) run(ctx context.Context) {
+	eventbus.Poll[struct{}](ctx, d.Interval, nil, func(ctx context.Context) bool {
+		batch, err := d.claim(ctx)
+		if err != nil {
+			log.Printf("очередь уведомлений: %v", err)
+		}
+		for _, q := range batch {
+			d.deliver(ctx, q)
+		}
+		// Полная пачка — возможно, в очереди есть ещё, не ждём
+		return len(batch) == d.Batch
+	})
+}
+
+// validChannel — канал, который умеет принимать POST /notify
+func validChannel(ch string) error {
+	switch ch {
+	case channelInbox, channelEmail, channelSMS, channelPush:
+		return nil
+	}
+	return fmt.Errorf("channel должен быть inbox, email, sms или push")
+}
+
+// queryRower — *sql.DB или *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// createNotification сохраняет уведомление: inbox сразу считается доставленным,
+// остальные каналы ставятся в очередь диспетчера
+func createNotification(q queryRower, n *Notification) error {
+	n.Status, n.SentAt, n.ReadAt, n.Read = statusQueued, nil, nil, false
+	if n.Channel == channelInbox {
+		now := time.Now()
+		n.Status, n.SentAt = statusSent, &now
+	}
+	return q.QueryRow(`
+		INSERT INTO notifications (user_id, channel, subject, message, status, sent_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6) RETURNING id, created_at`,
+		n.UserID, n.Channel, n.Subject, n.Message, n.Status, n.SentAt).Scan(&n.ID, &n.CreatedAt)
+}
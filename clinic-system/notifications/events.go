@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"eventbus"
+)
+
+// eventConsumer подписывает сервис на доменные события: запись, отмена и
+// перенос приёма, выданный чек и слот из листа ожидания превращаются
+// в уведомления пациенту
+func eventConsumer(db *sql.DB, dsn string) *eventbus.Consumer {
+	c := eventbus.NewConsumer(db, dsn, "notifications")
+	c.Handle(eventbus.AppointmentBooked, func(ctx context.Context, ev eventbus.Event) error {
+		return notifyAppointment(ctx, db, ev, tplBookingConfirmation)
+	})
+	c.Handle(eventbus.AppointmentCancelled, func(ctx context.Context, ev eventbus.Event) error {
+		return notifyAppointment(ctx, db, ev, tplAppointmentCancelled)
+	})
+	c.Handle(eventbus.AppointmentRescheduled, func(ctx context.Context, ev eventbus.Event) error {
+		return notifyAppointment(ctx, db, ev, tplAppointmentRescheduled)
+	})
+	c.Handle(eventbus.ReceiptIssued, func(ctx context.Context, ev eventbus.Event) error {
+		return notifyReceipt(ctx, db, ev)
+	})
+	c.Handle(eventbus.WaitlistOffered, func(ctx context.Context, ev eventbus.Event) error {
+		return notifyWaitlistOffer(ctx, db, ev)
+	})
+	return c
+}
+
+// notifyAppointment уведомляет пациента о записи или отмене приёма
+func notifyAppointment(ctx context.Context, db *sql.DB, ev eventbus.Event, tpl string) error {
+	var a eventbus.Appointment
+	if err := ev.Decode(&a); err != nil {
+		return err
+	}
+	data, err := appointmentData(ctx, db, a.PatientID, a.DoctorID, a.Start)
+	if err != nil {
+		return err
+	}
+	data["reason"] = a.Reason
+	if a.Reason == "" {
+		data["reason"] = "—"
+	}
+	if a.PreviousStart != nil {
+		data["previous_date"] = a.PreviousStart.Format("02.01.2006")
+		data["previous_time"] = a.PreviousStart.Format("15:04")
+	}
+	return notifyByPreferences(ctx, db, ev.ID, a.PatientID, tpl, clinicRef(a.ClinicID), data)
+}
+
+// notifyWaitlistOffer сообщает пациенту, что для него придержан слот
+func notifyWaitlistOffer(ctx context.Context, db *sql.DB, ev eventbus.Event) error {
+	var o eventbus.WaitlistOffer
+	if err := ev.Decode(&o); err != nil {
+		return err
+	}
+	data, err := appointmentData(ctx, db, o.PatientID, o.DoctorID, o.Start)
+	if err != nil {
+		return err
+	}
+	data["expires_at"] = o.ExpiresAt.Format("02.01.2006 15:04")
+	return notifyByPreferences(ctx, db, ev.ID, o.PatientID, tplWaitlistOffer, clinicRef(o.ClinicID), data)
+}
+
+// appointmentData — подстановки о пациенте, враче и времени приёма
+func appointmentData(ctx context.Context, db *sql.DB, patientID, doctorID int, start time.Time) (map[string]string, error) {
+	var patient, doctor, specialty, clinic, address string
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(u.full_name, ''), COALESCE(d.full_name, ''), COALESCE(d.specialty, ''),
+		       COALESCE(cl.name, ''), COALESCE(cl.address, '')
+		FROM users u
+		JOIN doctors d ON d.id = $2
+		LEFT JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE u.id = $1`, patientID, doctorID).Scan(&patient, &doctor, &specialty, &clinic, &address)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"patient_name":   patient,
+		"doctor_name":    doctor,
+		"specialty":      specialty,
+		"date":           start.Format("02.01.2006"),
+		"time":           start.Format("15:04"),
+		"clinic_name":    clinic,
+		"clinic_address": address,
+	}, nil
+}
+
+// notifyReceipt отправляет пациенту чек об оплате
+func notifyReceipt(ctx context.Context, db *sql.DB, ev eventbus.Event) error {
+	var r eventbus.Receipt
+	if err := ev.Decode(&r); err != nil {
+		return err
+	}
+	var patient, clinic string
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(u.full_name, ''), COALESCE((SELECT name FROM clinics WHERE id = $2), '')
+		FROM users u WHERE u.id = $1`, r.PatientID, r.ClinicID).Scan(&patient, &clinic)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		"patient_name":   patient,
+		"receipt_number": r.Number,
+		"amount":         r.Amount,
+		"currency":       r.Currency,
+		"clinic_name":    clinic,
+		"date":           r.IssuedAt.Format("02.01.2006"),
+	}
+	return notifyByPreferences(ctx, db, ev.ID, r.PatientID, tplPaymentReceipt, clinicRef(r.ClinicID), data)
+}
+
+// notifyByPreferences создаёт уведомление в каждом канале, включённом у
+// пользователя. Повторная доставка того же события дублей не создаёт:
+// уведомления уникальны по (event_id, user_id, channel).
+func notifyByPreferences(ctx context.Context, db *sql.DB, eventID int64, userID int, tpl string, clinicID *int, data map[string]string) error {
+	prefs, err := loadPreferences(db, userID)
+	if err != nil {
+		return err
+	}
+	t, err := renderTemplate(db, tpl, prefs.Language, clinicID, data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, ch := range prefs.channels() {
+		status, sentAt := statusQueued, (*time.Time)(nil)
+		if ch == channelInbox {
+			now := time.Now()
+			status, sentAt = statusSent, &now
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO notifications (user_id, channel, subject, message, status, sent_at, event_id)
+			VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7)
+			ON CONFLICT (event_id, user_id, channel) WHERE event_id IS NOT NULL DO NOTHING`,
+			userID, ch, t.Subject, t.Body, status, sentAt, eventID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// clinicRef — id клиники из события; 0 означает, что клиника неизвестна
+func clinicRef(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
@@ -3,6 +3,7 @@ module notifications
 go 1.24.1
 
 require (
+	eventbus v0.0.0
 	github.com/gin-gonic/gin v1.10.0
 	github.com/lib/pq v1.10.9
 )
@@ -35,3 +36,5 @@ require (
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace eventbus => ../eventbus
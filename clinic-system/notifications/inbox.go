@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inboxFilter — параметры GET /notify
+type inboxFilter struct {
+	UserID     int
+	UnreadOnly bool
+	Limit      int
+	Offset     int
+}
+
+func parseInboxFilter(c *gin.Context, userID int) (*inboxFilter, error) {
+	f := inboxFilter{UserID: userID, Limit: 20}
+	if s := c.Query("unread"); s != "" {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("unread должен быть true или false")
+		}
+		f.UnreadOnly = v
+	}
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("limit должен быть от 1 до 100")
+		}
+		f.Limit = n
+	}
+	if s := c.Query("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("неверный offset")
+		}
+		f.Offset = n
+	}
+	return &f, nil
+}
+
+// queryInbox возвращает страницу уведомлений пользователя (новые сверху)
+// и общее число подходящих
+func queryInbox(db *sql.DB, f *inboxFilter) ([]Notification, int, error) {
+	var total int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)`, f.UserID, f.UnreadOnly).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, user_id, COALESCE(channel, ''), COALESCE(subject, ''), COALESCE(message, ''), status, created_at, sent_at, read_at
+		FROM notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`, f.UserID, f.UnreadOnly, f.Limit, f.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Channel, &n.Subject, &n.Message, &n.Status, &n.CreatedAt, &n.SentAt, &n.ReadAt); err != nil {
+			return nil, 0, err
+		}
+		n.Read = n.ReadAt != nil
+		list = append(list, n)
+	}
+	return list, total, rows.Err()
+}
+
+func unreadCount(db *sql.DB, userID int) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL`, userID).Scan(&n)
+	return n, err
+}
+
+// markRead отмечает уведомление пользователя прочитанным. Повторная отметка
+// не меняет время прочтения. Чужое или несуществующее — sql.ErrNoRows.
+func markRead(db *sql.DB, userID, id int) (*Notification, error) {
+	var n Notification
+	err := db.QueryRow(`
+		UPDATE notifications SET read_at = COALESCE(read_at, NOW())
+		WHERE id = $1 AND user_id = $2
+		RETURNING id, user_id, COALESCE(channel, ''), COALESCE(subject, ''), COALESCE(message, ''), status, created_at, sent_at, read_at`, id, userID).
+		Scan(&n.ID, &n.UserID, &n.Channel, &n.Subject, &n.Message, &n.Status, &n.CreatedAt, &n.SentAt, &n.ReadAt)
+	if err != nil {
+		return nil, err
+	}
+	n.Read = true
+	return &n, nil
+}
+
+// markAllRead отмечает прочитанными все уведомления пользователя, возвращает их число
+func markAllRead(db *sql.DB, userID int) (int64, error) {
+	res, err := db.Exec(`UPDATE notifications SET read_at = NOW() WHERE user_id = $1 AND read_at IS NULL`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -12,11 +16,16 @@ import (
 )
 
 type Notification struct {
-	ID      int       `json:"id"`
-	UserID  int       `json:"user_id"`
-	Channel string    `json:"channel"`
-	Message string    `json:"message"`
-	SentAt  time.Time `json:"sent_at"`
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Channel   string     `json:"channel"`
+	Subject   string     `json:"subject,omitempty"`
+	Message   string     `json:"message"`
+	Status    string     `json:"status"` // queued, sent, failed
+	CreatedAt time.Time  `json:"created_at"`
+	SentAt    *time.Time `json:"sent_at"`
+	Read      bool       `json:"read"`
+	ReadAt    *time.Time `json:"read_at"`
 }
 
 func main() {
@@ -31,51 +40,381 @@ func main() {
 	}
 	defer db.Close()
 
+	senders, err := newSendersFromEnv()
+	if err != nil {
+		log.Fatal("Ошибка настройки каналов доставки:", err)
+	}
+	go newDispatcherFromEnv(db, senders).run(context.Background())
+
+	reminderEvery := time.Minute
+	if sec, err := strconv.Atoi(os.Getenv("REMINDER_SWEEP_SECONDS")); err == nil && sec > 0 {
+		reminderEvery = time.Duration(sec) * time.Second
+	}
+	go (&reminderPlanner{db: db, Interval: reminderEvery}).run(context.Background())
+
+	go func() {
+		if err := eventConsumer(db, dbURL).Run(context.Background()); err != nil {
+			log.Fatal("Ошибка подписки на события:", err)
+		}
+	}()
+
+	hub := newStreamHub(db, dbURL)
+	go func() {
+		if err := hub.run(context.Background()); err != nil {
+			log.Fatal("Ошибка подписки на поток уведомлений:", err)
+		}
+	}()
+
 	r := gin.Default()
 
-	// Создать уведомление
+	// Создать уведомление. Текст задаётся готовым (message) или шаблоном:
+	// {"template": "booking_confirmation", "clinic_id": 1, "data": {...}} —
+	// тогда он рендерится на языке пользователя (или language из запроса).
+	// Письма, SMS и push ставятся в очередь и отправляются диспетчером;
+	// inbox сразу считается доставленным. Отправлять может персонал клиники
+	// своим пациентам и сотрудникам, администратор системы — всем.
 	r.POST("/notify", func(c *gin.Context) {
-		var n Notification
-		if err := c.BindJSON(&n); err != nil {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		var req struct {
+			UserID   int               `json:"user_id"`
+			Channel  string            `json:"channel"`
+			Subject  string            `json:"subject"`
+			Message  string            `json:"message"`
+			Template string            `json:"template"`
+			ClinicID *int              `json:"clinic_id"`
+			Language string            `json:"language"`
+			Data     map[string]string `json:"data"`
+		}
+		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
 			return
 		}
-		n.SentAt = time.Now()
+		allowed, err := u.canNotify(db, req.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+			return
+		}
+		if !allowed || (req.ClinicID != nil && u.Role != roleAdmin && *req.ClinicID != *u.ClinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "недостаточно прав"})
+			return
+		}
+		n := Notification{UserID: req.UserID, Channel: req.Channel, Subject: req.Subject, Message: req.Message}
+		if n.Channel == "" {
+			n.Channel = channelInbox
+		}
+		if err := validChannel(n.Channel); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-		err := db.QueryRow(`
-			INSERT INTO notifications (user_id, channel, message, sent_at)
-			VALUES ($1, $2, $3, $4) RETURNING id`,
-			n.UserID, n.Channel, n.Message, n.SentAt).Scan(&n.ID)
+		if req.Template != "" {
+			lang := req.Language
+			if lang == "" {
+				var err error
+				if lang, err = userLanguage(db, req.UserID); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении настроек"})
+					return
+				}
+			}
+			t, err := renderTemplate(db, req.Template, lang, req.ClinicID, req.Data)
+			if errors.Is(err, errUnknownTemplate) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при подготовке текста"})
+				return
+			}
+			n.Subject, n.Message = t.Subject, t.Body
+		}
+		if n.Message == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "нужен message или template"})
+			return
+		}
 
-		if err != nil {
+		if err := createNotification(db, &n); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при создании уведомления"})
 			return
 		}
 		c.JSON(http.StatusCreated, n)
 	})
 
-	// Получить уведомления
-	r.GET("/notify", func(c *gin.Context) {
-		rows, err := db.Query(`
-			SELECT id, user_id, channel, message, sent_at
-			FROM notifications
-			ORDER BY sent_at DESC`)
+	// Действующие шаблоны на всех языках: ?clinic_id= показывает, что увидят пациенты клиники
+	r.GET("/templates", func(c *gin.Context) {
+		if _, ok := requireUser(db, c); !ok {
+			return
+		}
+		clinicID, ok := optionalClinicID(c)
+		if !ok {
+			return
+		}
+		list, err := listTemplates(db, clinicID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении уведомлений"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении шаблонов"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	// Переопределить шаблон: {"language", "clinic_id", "subject", "body"}.
+	// Без clinic_id — для всей системы (только администратор системы).
+	r.PUT("/templates/:name", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		def, found := builtinTemplates[c.Param("name")]
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": errUnknownTemplate.Error()})
+			return
+		}
+		var req struct {
+			Language string `json:"language"`
+			ClinicID *int   `json:"clinic_id"`
+			templateText
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+		if err := validLanguage(req.Language); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if strings.TrimSpace(req.Body) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "текст шаблона не может быть пустым"})
+			return
+		}
+		for _, text := range []string{req.Subject, req.Body} {
+			if err := def.checkPlaceholders(text); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if !u.managesClinic(req.ClinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "менять шаблоны может только администратор"})
+			return
+		}
+
+		if err := saveTemplate(db, c.Param("name"), req.Language, req.ClinicID, req.templateText, u.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сохранить шаблон"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"name": c.Param("name"), "language": req.Language, "clinic_id": req.ClinicID,
+			"subject": req.Subject, "body": req.Body})
+	})
+
+	// Удалить переопределение: ?language=&clinic_id=
+	r.DELETE("/templates/:name", func(c *gin.Context) {
+		u, ok := requireUser(db, c)
+		if !ok {
+			return
+		}
+		clinicID, ok := optionalClinicID(c)
+		if !ok {
+			return
+		}
+		if !u.managesClinic(clinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "менять шаблоны может только администратор"})
+			return
+		}
+		removed, err := deleteTemplate(db, c.Param("name"), c.Query("language"), clinicID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось удалить шаблон"})
+			return
+		}
+		if !removed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "переопределение не найдено"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	// Предпросмотр: {"language", "clinic_id", "data", "subject"?, "body"?}.
+	// Без data подставляются примерные значения; subject/body позволяют
+	// проверить текст до сохранения.
+	r.POST("/templates/:name/preview", func(c *gin.Context) {
+		if _, ok := requireUser(db, c); !ok {
+			return
+		}
+		name := c.Param("name")
+		def, found := builtinTemplates[name]
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": errUnknownTemplate.Error()})
+			return
+		}
+		var req struct {
+			Language string            `json:"language"`
+			ClinicID *int              `json:"clinic_id"`
+			Data     map[string]string `json:"data"`
+			Subject  string            `json:"subject"`
+			Body     string            `json:"body"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+		if req.Language == "" {
+			req.Language = defaultLanguage
+		}
+		if err := validLanguage(req.Language); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		defer rows.Close()
 
-		var list []Notification
-		for rows.Next() {
-			var n Notification
-			if err := rows.Scan(&n.ID, &n.UserID, &n.Channel, &n.Message, &n.SentAt); err == nil {
-				list = append(list, n)
+		t, err := resolveTemplate(db, name, req.Language, req.ClinicID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении шаблона"})
+			return
+		}
+		if req.Body != "" {
+			t = templateText{Subject: req.Subject, Body: req.Body}
+		}
+		for _, text := range []string{t.Subject, t.Body} {
+			if err := def.checkPlaceholders(text); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
 			}
 		}
+		data := def.Sample
+		if req.Data != nil {
+			data = req.Data
+		}
+		c.JSON(http.StatusOK, t.render(data))
+	})
+
+	// Настройки уведомлений и напоминаний
+	r.GET("/preferences", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		p, err := loadPreferences(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении настроек"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	// Изменить настройки. Запланированные напоминания пересчитываются
+	// при следующем проходе планировщика.
+	r.PUT("/preferences", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		var p Preferences
+		if err := c.BindJSON(&p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+		if err := p.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := savePreferences(db, userID, &p); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сохранить настройки"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	// Входящие пользователя: ?unread=true&limit=&offset=
+	// Общее число подходящих — в X-Total-Count, непрочитанных — в X-Unread-Count.
+	r.GET("/notify", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		f, err := parseInboxFilter(c, userID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		list, total, err := queryInbox(db, f)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении уведомлений"})
+			return
+		}
+		unread, err := unreadCount(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении уведомлений"})
+			return
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		c.Header("X-Unread-Count", strconv.Itoa(unread))
 		c.JSON(http.StatusOK, list)
 	})
 
+	// Счётчик непрочитанных для значка в интерфейсе
+	r.GET("/notify/unread-count", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		unread, err := unreadCount(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении уведомлений"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"unread": unread})
+	})
+
+	// Живой поток (Server-Sent Events): event: ready с числом непрочитанных,
+	// затем notification — новое уведомление, appointment.* — изменения
+	// приёмов пациента, resync — события могли потеряться, стоит перечитать.
+	// При переподключении с Last-Event-ID сначала приходят пропущенные
+	// уведомления; повторы клиент отбрасывает по id.
+	r.GET("/notify/stream", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		hub.serve(c, userID)
+	})
+
+	// Отметить уведомление прочитанным
+	r.POST("/notify/:id/read", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID уведомления"})
+			return
+		}
+		n, err := markRead(db, userID, id)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "уведомление не найдено"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось отметить уведомление"})
+			return
+		}
+		c.JSON(http.StatusOK, n)
+	})
+
+	// Отметить прочитанными все уведомления пользователя
+	r.POST("/notify/read-all", func(c *gin.Context) {
+		userID, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		updated, err := markAllRead(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось отметить уведомления"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"updated": updated, "unread": 0})
+	})
+
 	if err := r.Run(":8086"); err != nil {
 		log.Fatal("Ошибка запуска notifications сервиса:", err)
 	}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+// Preferences — какие каналы пользователь разрешил и когда напоминать о приёмах
+type Preferences struct {
+	Inbox bool `json:"inbox"`
+	Email bool `json:"email"`
+	SMS   bool `json:"sms"`
+	Push  bool `json:"push"`
+	// Язык уведомлений: ru или en
+	Language string `json:"language"`
+	// Минуты до начала приёма; пустой список отключает напоминания
+	ReminderOffsets []int64 `json:"reminder_offsets"`
+}
+
+// defaultPreferences должны совпадать со значениями по умолчанию в notification_preferences
+func defaultPreferences() Preferences {
+	return Preferences{Inbox: true, Email: true, Language: defaultLanguage, ReminderOffsets: []int64{24 * 60, 2 * 60}}
+}
+
+const (
+	maxReminderOffsets = 5
+	maxReminderOffset  = 7 * 24 * 60
+)
+
+func (p *Preferences) validate() error {
+	if p.Language == "" {
+		p.Language = defaultLanguage
+	}
+	if err := validLanguage(p.Language); err != nil {
+		return err
+	}
+	if len(p.ReminderOffsets) > maxReminderOffsets {
+		return fmt.Errorf("не больше %d напоминаний на приём", maxReminderOffsets)
+	}
+	for _, off := range p.ReminderOffsets {
+		if off < 1 || off > maxReminderOffset {
+			return fmt.Errorf("напоминание можно поставить за 1–%d минут до приёма", maxReminderOffset)
+		}
+	}
+	slices.Sort(p.ReminderOffsets)
+	p.ReminderOffsets = slices.Compact(p.ReminderOffsets)
+	slices.Reverse(p.ReminderOffsets)
+	return nil
+}
+
+func loadPreferences(db *sql.DB, userID int) (*Preferences, error) {
+	p := Preferences{}
+	err := db.QueryRow(`
+		SELECT inbox, email, sms, push, language, reminder_offsets
+		FROM notification_preferences WHERE user_id = $1`, userID).
+		Scan(&p.Inbox, &p.Email, &p.SMS, &p.Push, &p.Language, pq.Array(&p.ReminderOffsets))
+	if errors.Is(err, sql.ErrNoRows) {
+		p = defaultPreferences()
+		return &p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.ReminderOffsets == nil {
+		p.ReminderOffsets = []int64{}
+	}
+	return &p, nil
+}
+
+func savePreferences(db *sql.DB, userID int, p *Preferences) error {
+	offsets := p.ReminderOffsets
+	if offsets == nil {
+		offsets = []int64{}
+	}
+	_, err := db.Exec(`
+		INSERT INTO notification_preferences (user_id, inbox, email, sms, push, language, reminder_offsets, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET
+			inbox = EXCLUDED.inbox, email = EXCLUDED.email, sms = EXCLUDED.sms, push = EXCLUDED.push,
+			language = EXCLUDED.language, reminder_offsets = EXCLUDED.reminder_offsets, updated_at = NOW()`,
+		userID, p.Inbox, p.Email, p.SMS, p.Push, p.Language, pq.Array(offsets))
+	return err
+}
+
+// channels — включённые каналы доставки
+func (p *Preferences) channels() []string {
+	var list []string
+	for _, ch := range []struct {
+		name string
+		on   bool
+	}{{channelInbox, p.Inbox}, {channelEmail, p.Email}, {channelSMS, p.SMS}, {channelPush, p.Push}} {
+		if ch.on {
+			list = append(list, ch.name)
+		}
+	}
+	return list
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Статусы приёма, которые интересны напоминаниям
+const appointmentBooked = "записан"
+
+// Статусы напоминаний, которые выставляются из Go; scheduled и cancelled
+// выставляются запросами планировщика
+const (
+	reminderSent    = "sent"
+	reminderExpired = "expired" // время приёма прошло, пока сервис не работал
+	reminderFailed  = "failed"  // не удалось подготовить текст, например из-за шаблона клиники
+)
+
+// reminderPlanner раз в Interval синхронизирует напоминания с приёмами:
+// планирует новые, отменяет лишние и превращает наступившие в уведомления.
+// Всё состояние хранится в appointment_reminders, поэтому после перезапуска
+// сервиса напоминания не теряются и не отправляются повторно.
+type reminderPlanner struct {
+	db       *sql.DB
+	Interval time.Duration
+}
+
+// schedule создаёт напоминания для записанных приёмов по настройкам пациентов.
+// Напоминание, отменённое раньше (например, приём переносили туда и обратно),
+// планируется снова.
+func (p *reminderPlanner) schedule(ctx context.Context) (int64, error) {
+	def := defaultPreferences()
+	res, err := p.db.ExecContext(ctx, `
+		INSERT INTO appointment_reminders (appointment_id, offset_minutes, channel, slot_start, send_at)
+		SELECT a.id, o.off, ch.channel, s.start_time, s.start_time - make_interval(mins => o.off)
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		LEFT JOIN notification_preferences np ON np.user_id = a.user_id
+		CROSS JOIN LATERAL unnest(COALESCE(np.reminder_offsets, $2::INTEGER[])) AS o(off)
+		CROSS JOIN LATERAL unnest(ARRAY[
+			CASE WHEN COALESCE(np.inbox, $3) THEN 'inbox' END,
+			CASE WHEN COALESCE(np.email, $4) THEN 'email' END,
+			CASE WHEN COALESCE(np.sms, $5) THEN 'sms' END,
+			CASE WHEN COALESCE(np.push, $6) THEN 'push' END
+		]) AS ch(channel)
+		WHERE a.status = $1
+		  AND ch.channel IS NOT NULL
+		  AND s.start_time - make_interval(mins => o.off) > NOW()
+		ON CONFLICT (appointment_id, offset_minutes, channel, slot_start) DO UPDATE
+		SET status = 'scheduled', send_at = EXCLUDED.send_at
+		WHERE appointment_reminders.status = 'cancelled'`,
+		appointmentBooked, pq.Array(def.ReminderOffsets), def.Inbox, def.Email, def.SMS, def.Push)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// cancelStale отменяет напоминания по отменённым и перенесённым приёмам,
+// а также те, что пациент отключил в настройках
+func (p *reminderPlanner) cancelStale(ctx context.Context) (int64, error) {
+	def := defaultPreferences()
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE appointment_reminders r SET status = 'cancelled'
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		LEFT JOIN notification_preferences np ON np.user_id = a.user_id
+		WHERE r.appointment_id = a.id
+		  AND r.status = 'scheduled'
+		  AND (a.status <> $1
+		       OR s.start_time <> r.slot_start
+		       OR NOT r.offset_minutes = ANY(COALESCE(np.reminder_offsets, $2::INTEGER[]))
+		       OR NOT CASE r.channel
+		                  WHEN 'inbox' THEN COALESCE(np.inbox, $3)
+		                  WHEN 'email' THEN COALESCE(np.email, $4)
+		                  WHEN 'sms' THEN COALESCE(np.sms, $5)
+		                  WHEN 'push' THEN COALESCE(np.push, $6)
+		                  ELSE false
+		              END)`,
+		appointmentBooked, pq.Array(def.ReminderOffsets), def.Inbox, def.Email, def.SMS, def.Push)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// dueReminder — наступившее напоминание со сведениями о приёме
+type dueReminder struct {
+	ID            int
+	AppointmentID int
+	UserID        int
+	Channel       string
+	Language      string
+	Start         time.Time
+	Patient       string
+	Doctor        string
+	Specialty     string
+	ClinicID      *int
+	Clinic        string
+	Address       string
+}
+
+// data — подстановки для шаблона appointment_reminder
+func (r dueReminder) data() map[string]string {
+	return map[string]string{
+		"patient_name":   r.Patient,
+		"doctor_name":    r.Doctor,
+		"specialty":      r.Specialty,
+		"date":           r.Start.Format("02.01.2006"),
+		"time":           r.Start.Format("15:04"),
+		"clinic_name":    r.Clinic,
+		"clinic_address": r.Address,
+	}
+}
+
+// sendDue превращает наступившие напоминания в уведомления. Уведомление и
+// отметка о напоминании пишутся в одной транзакции — дубли невозможны.
+// Каждое напоминание обрабатывается под своей точкой сохранения: ошибка
+// в одном (например, в шаблоне клиники) помечает его failed, а не откатывает
+// всю пачку.
+func (p *reminderPlanner) sendDue(ctx context.Context) (int, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Напоминания по отменённым и перенесённым приёмам сюда не попадают:
+	// их отменит cancelStale
+	rows, err := tx.QueryContext(ctx, `
+		SELECT r.id, r.appointment_id, a.user_id, r.channel, COALESCE(np.language, $2), r.slot_start,
+		       COALESCE(u.full_name, ''), COALESCE(d.full_name, ''), COALESCE(d.specialty, ''),
+		       cl.id, COALESCE(cl.name, ''), COALESCE(cl.address, '')
+		FROM appointment_reminders r
+		JOIN appointments a ON a.id = r.appointment_id
+		JOIN users u ON u.id = a.user_id
+		LEFT JOIN notification_preferences np ON np.user_id = a.user_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		LEFT JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE r.status = 'scheduled'
+		  AND r.send_at <= NOW()
+		  AND a.status = $1
+		  AND s.start_time = r.slot_start
+		ORDER BY r.send_at
+		LIMIT 100
+		FOR UPDATE OF r SKIP LOCKED`, appointmentBooked, defaultLanguage)
+	if err != nil {
+		return 0, err
+	}
+	var due []dueReminder
+	for rows.Next() {
+		var r dueReminder
+		if err := rows.Scan(&r.ID, &r.AppointmentID, &r.UserID, &r.Channel, &r.Language, &r.Start,
+			&r.Patient, &r.Doctor, &r.Specialty, &r.ClinicID, &r.Clinic, &r.Address); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, r := range due {
+		if !r.Start.After(time.Now()) {
+			if _, err := tx.ExecContext(ctx, `UPDATE appointment_reminders SET status = $2 WHERE id = $1`,
+				r.ID, reminderExpired); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT reminder`); err != nil {
+			return 0, err
+		}
+		if err := sendReminder(ctx, tx, r); err != nil {
+			log.Printf("напоминание %d по приёму %d: %v", r.ID, r.AppointmentID, err)
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT reminder`); err != nil {
+				return 0, err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE appointment_reminders SET status = $2 WHERE id = $1`,
+				r.ID, reminderFailed); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, tx.Commit()
+}
+
+// sendReminder создаёт уведомление по напоминанию и отмечает его отправленным
+func sendReminder(ctx context.Context, tx *sql.Tx, r dueReminder) error {
+	t, err := renderTemplate(tx, tplAppointmentReminder, r.Language, r.ClinicID, r.data())
+	if err != nil {
+		return err
+	}
+	n := Notification{UserID: r.UserID, Channel: r.Channel, Subject: t.Subject, Message: t.Body}
+	if err := createNotification(tx, &n); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE appointment_reminders SET status = $2, notification_id = $3 WHERE id = $1`,
+		r.ID, reminderSent, n.ID)
+	return err
+}
+
+func (p *reminderPlanner) run(ctx context.Context) {
+	for {
+		if _, err := p.cancelStale(ctx); err != nil {
+			log.Printf("напоминания: отмена: %v", err)
+		}
+		if _, err := p.schedule(ctx); err != nil {
+			log.Printf("напоминания: планирование: %v", err)
+		}
+		if _, err := p.sendDue(ctx); err != nil {
+			log.Printf("напоминания: отправка: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.Interval):
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Каналы доставки. inbox — только во входящих в приложении, без отправки.
+const (
+	channelInbox = "inbox"
+	channelEmail = "email"
+	channelSMS   = "sms"
+	channelPush  = "push"
+)
+
+// Статусы доставки уведомления
+const (
+	statusQueued = "queued"
+	statusSent   = "sent"
+	statusFailed = "failed"
+)
+
+// Message — то, что уходит получателю по одному каналу
+type Message struct {
+	NotificationID int
+	UserID         int
+	To             string // email, телефон или ID пользователя для push
+	Subject        string
+	Body           string
+}
+
+// Sender доставляет сообщения одного канала
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// errPermanent — ошибка, которую повтор не исправит (нет адреса, отказ провайдера)
+var errPermanent = errors.New("постоянная ошибка доставки")
+
+func permanent(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errPermanent, fmt.Sprintf(format, args...))
+}
+
+// defaultSubject — тема письма, если у уведомления своей нет
+const defaultSubject = "Уведомление клиники"
+
+// newSendersFromEnv собирает отправителей по каналам.
+// EMAIL_SENDER=smtp|log, SMS_SENDER=http|log, PUSH_SENDER=log; по умолчанию всё пишется в лог
+// (или в файл NOTIFY_SINK_FILE), чтобы локально ничего не уходило наружу.
+func newSendersFromEnv() (map[string]Sender, error) {
+	sink, err := newSinkSenderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	senders := map[string]Sender{
+		channelEmail: sink,
+		channelSMS:   sink,
+		channelPush:  sink,
+	}
+
+	switch name := os.Getenv("EMAIL_SENDER"); name {
+	case "", "log":
+	case "smtp":
+		if senders[channelEmail], err = newSMTPSenderFromEnv(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("неизвестный EMAIL_SENDER %q", name)
+	}
+
+	switch name := os.Getenv("SMS_SENDER"); name {
+	case "", "log":
+	case "http":
+		if senders[channelSMS], err = newHTTPSMSSenderFromEnv(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("неизвестный SMS_SENDER %q", name)
+	}
+
+	switch name := os.Getenv("PUSH_SENDER"); name {
+	case "", "log":
+	default:
+		return nil, fmt.Errorf("неизвестный PUSH_SENDER %q", name)
+	}
+	return senders, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// sinkSender никуда не отправляет: пишет сообщения в лог или построчно
+// в JSON-файл NOTIFY_SINK_FILE. Для локальной разработки и тестов.
+type sinkSender struct {
+	mu   sync.Mutex
+	file *os.File // nil — писать в лог
+}
+
+func newSinkSenderFromEnv() (*sinkSender, error) {
+	path := os.Getenv("NOTIFY_SINK_FILE")
+	if path == "" {
+		return &sinkSender{}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("NOTIFY_SINK_FILE: %w", err)
+	}
+	return &sinkSender{file: f}, nil
+}
+
+func (s *sinkSender) Send(_ context.Context, msg Message) error {
+	if s.file == nil {
+		log.Printf("уведомление %d → %s: %s", msg.NotificationID, msg.To, msg.Body)
+		return nil
+	}
+	line, err := json.Marshal(struct {
+		Message
+		At time.Time
+	}{msg, time.Now()})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
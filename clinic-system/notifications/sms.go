@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// httpSMSSender — адаптер SMS-провайдера с JSON API:
+// POST SMS_API_URL {"to", "text", "sender"} с заголовком Authorization: Bearer SMS_API_TOKEN.
+type httpSMSSender struct {
+	url    string
+	token  string
+	sender string
+	client *http.Client
+}
+
+func newHTTPSMSSenderFromEnv() (*httpSMSSender, error) {
+	url := os.Getenv("SMS_API_URL")
+	if url == "" {
+		return nil, errors.New("для SMS_SENDER=http нужен SMS_API_URL")
+	}
+	return &httpSMSSender{
+		url:    url,
+		token:  os.Getenv("SMS_API_TOKEN"),
+		sender: os.Getenv("SMS_SENDER_NAME"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *httpSMSSender) Send(ctx context.Context, msg Message) error {
+	if msg.To == "" {
+		return permanent("у пользователя %d нет телефона", msg.UserID)
+	}
+	body, err := json.Marshal(map[string]string{"to": msg.To, "text": msg.Body, "sender": s.sender})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("SMS-провайдер ответил %s: %s", resp.Status, bytes.TrimSpace(detail))
+	// 4xx, кроме 429, — запрос неверен и повтор не поможет
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return err
+}
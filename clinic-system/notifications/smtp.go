@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// smtpSender отправляет письма через SMTP-сервер.
+// SMTP_HOST, SMTP_PORT (587), SMTP_USER, SMTP_PASSWORD, SMTP_FROM.
+type smtpSender struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPSenderFromEnv() (*smtpSender, error) {
+	host := os.Getenv("SMTP_HOST")
+	from := os.Getenv("SMTP_FROM")
+	if host == "" || from == "" {
+		return nil, errors.New("для EMAIL_SENDER=smtp нужны SMTP_HOST и SMTP_FROM")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	s := &smtpSender{addr: net.JoinHostPort(host, port), host: host, from: from}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		s.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return s, nil
+}
+
+func (s *smtpSender) Send(ctx context.Context, msg Message) error {
+	if msg.To == "" {
+		return permanent("у пользователя %d нет email", msg.UserID)
+	}
+	subject := msg.Subject
+	if subject == "" {
+		subject = defaultSubject
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	// net/smtp не принимает контекст: отправляем в горутине и не ждём дольше ctx
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, []byte(b.String()))
+	}()
+	select {
+	case err := <-done:
+		// 5xx от сервера (неверный адрес и т.п.) повторять бессмысленно
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) && tpErr.Code >= 500 {
+			return permanent("SMTP: %v", err)
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
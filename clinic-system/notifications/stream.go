@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// streamChannel — канал NOTIFY, который наполняют триггеры из 22_user_stream.sql
+const streamChannel = "user_stream"
+
+// streamHeartbeat — как часто слать комментарий-пинг, чтобы прокси
+// не закрывали простаивающее соединение
+const streamHeartbeat = 25 * time.Second
+
+// streamMessage — событие для клиента в формате Server-Sent Events
+type streamMessage struct {
+	ID    string // пусто — событие без id, Last-Event-ID им не сдвигается
+	Event string
+	Data  json.RawMessage
+}
+
+func (m streamMessage) write(w gin.ResponseWriter) error {
+	if m.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", m.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Event, m.Data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// streamHub раздаёт события подключённым клиентам этого экземпляра сервиса.
+// Источник — LISTEN user_stream, поэтому клиенты получают и то, что создали
+// другие экземпляры и другие сервисы.
+type streamHub struct {
+	db  *sql.DB
+	dsn string
+
+	mu      sync.Mutex
+	clients map[int]map[chan streamMessage]struct{}
+}
+
+func newStreamHub(db *sql.DB, dsn string) *streamHub {
+	return &streamHub{db: db, dsn: dsn, clients: map[int]map[chan streamMessage]struct{}{}}
+}
+
+func (h *streamHub) subscribe(userID int) chan streamMessage {
+	ch := make(chan streamMessage, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = map[chan streamMessage]struct{}{}
+	}
+	h.clients[userID][ch] = struct{}{}
+	return ch
+}
+
+func (h *streamHub) unsubscribe(userID int, ch chan streamMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients[userID], ch)
+	if len(h.clients[userID]) == 0 {
+		delete(h.clients, userID)
+	}
+}
+
+// send отправляет событие всем соединениям пользователя (userID == 0 — всем).
+// Клиент, который не успевает читать, событие теряет: при переподключении
+// он дочитает уведомления по Last-Event-ID.
+func (h *streamHub) send(userID int, m streamMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for uid, set := range h.clients {
+		if userID != 0 && uid != userID {
+			continue
+		}
+		for ch := range set {
+			select {
+			case ch <- m:
+			default:
+				log.Printf("поток уведомлений: клиент %d не успевает, событие %s пропущено", uid, m.Event)
+			}
+		}
+	}
+}
+
+func (h *streamHub) connected(userID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients[userID]) > 0
+}
+
+// loadNotification читает уведомление по id
+func loadNotification(db *sql.DB, id int) (*Notification, error) {
+	var n Notification
+	err := db.QueryRow(`
+		SELECT id, user_id, COALESCE(channel, ''), COALESCE(subject, ''), COALESCE(message, ''), status, created_at, sent_at, read_at
+		FROM notifications WHERE id = $1`, id).
+		Scan(&n.ID, &n.UserID, &n.Channel, &n.Subject, &n.Message, &n.Status, &n.CreatedAt, &n.SentAt, &n.ReadAt)
+	if err != nil {
+		return nil, err
+	}
+	n.Read = n.ReadAt != nil
+	return &n, nil
+}
+
+// loadEventPayload читает данные события шины по id
+func loadEventPayload(db *sql.DB, id int) (json.RawMessage, error) {
+	var data json.RawMessage
+	if err := db.QueryRow(`SELECT payload FROM events WHERE id = $1`, id).Scan(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func notificationMessage(n *Notification) (streamMessage, error) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return streamMessage{}, err
+	}
+	return streamMessage{ID: strconv.Itoa(n.ID), Event: "notification", Data: data}, nil
+}
+
+// dispatch разбирает NOTIFY и пересылает событие адресату
+func (h *streamHub) dispatch(payload string) {
+	var msg struct {
+		UserID int    `json:"user_id"`
+		Type   string `json:"type"`
+		ID     int    `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("поток уведомлений: %v", err)
+		return
+	}
+	// Данные читаем из базы, только если адресат подключён к этому экземпляру
+	if !h.connected(msg.UserID) {
+		return
+	}
+	if msg.Type != "notification" {
+		data, err := loadEventPayload(h.db, msg.ID)
+		if err != nil {
+			log.Printf("поток уведомлений: событие %d: %v", msg.ID, err)
+			return
+		}
+		h.send(msg.UserID, streamMessage{Event: msg.Type, Data: data})
+		return
+	}
+	n, err := loadNotification(h.db, msg.ID)
+	if err != nil {
+		log.Printf("поток уведомлений: уведомление %d: %v", msg.ID, err)
+		return
+	}
+	m, err := notificationMessage(n)
+	if err != nil {
+		log.Printf("поток уведомлений: уведомление %d: %v", msg.ID, err)
+		return
+	}
+	h.send(msg.UserID, m)
+}
+
+// run слушает базу, пока не отменён ctx
+func (h *streamHub) run(ctx context.Context) error {
+	listener := pq.NewListener(h.dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("поток уведомлений: LISTEN: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(streamChannel); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			if n == nil {
+				// Соединение переустановлено: что-то могло потеряться,
+				// клиентам стоит перечитать данные
+				h.send(0, streamMessage{Event: "resync", Data: json.RawMessage("{}")})
+				continue
+			}
+			h.dispatch(n.Extra)
+		}
+	}
+}
+
+// missedNotifications — уведомления пользователя новее lastID, по возрастанию
+func missedNotifications(db *sql.DB, userID, lastID int) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, COALESCE(channel, ''), COALESCE(subject, ''), COALESCE(message, ''), status, created_at, sent_at, read_at
+		FROM notifications
+		WHERE user_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT 100`, userID, lastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Notification
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Channel, &n.Subject, &n.Message, &n.Status, &n.CreatedAt, &n.SentAt, &n.ReadAt); err != nil {
+			return nil, err
+		}
+		n.Read = n.ReadAt != nil
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// serve держит SSE-соединение пользователя: сначала число непрочитанных
+// и пропущенные уведомления (по Last-Event-ID), затем живые события
+func (h *streamHub) serve(c *gin.Context, userID int) {
+	// Подписываемся до чтения пропущенного, чтобы ничего не проскочило между ними
+	ch := h.subscribe(userID)
+	defer h.unsubscribe(userID, ch)
+
+	unread, err := unreadCount(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при подключении к потоку"})
+		return
+	}
+	var missed []Notification
+	if lastID, err := strconv.Atoi(c.GetHeader("Last-Event-ID")); err == nil {
+		if missed, err = missedNotifications(h.db, userID, lastID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при подключении к потоку"})
+			return
+		}
+	}
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx перед gateway не должен буферизовать
+	w.WriteHeader(http.StatusOK)
+
+	ready, _ := json.Marshal(gin.H{"unread": unread})
+	if err := (streamMessage{Event: "ready", Data: ready}).write(w); err != nil {
+		return
+	}
+	for i := range missed {
+		m, err := notificationMessage(&missed[i])
+		if err != nil {
+			return
+		}
+		if err := m.write(w); err != nil {
+			return
+		}
+	}
+
+	ping := time.NewTicker(streamHeartbeat)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case m := <-ch:
+			if err := m.write(w); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
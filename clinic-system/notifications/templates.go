@@ -0,0 +1,376 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Языки уведомлений; первый — язык по умолчанию
+var supportedLanguages = []string{"ru", "en"}
+
+const defaultLanguage = "ru"
+
+// Имена шаблонов
+const (
+	tplBookingConfirmation    = "booking_confirmation"
+	tplAppointmentReminder    = "appointment_reminder"
+	tplAppointmentCancelled   = "appointment_cancelled"
+	tplAppointmentRescheduled = "appointment_rescheduled"
+	tplPaymentReceipt         = "payment_receipt"
+	tplPasswordReset          = "password_reset"
+	tplWaitlistOffer          = "waitlist_offer"
+)
+
+// templateText — тема (для email) и текст уведомления
+type templateText struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// templateDef — встроенный шаблон: допустимые подстановки, пример данных
+// для предпросмотра и тексты на каждом языке
+type templateDef struct {
+	Vars     []string
+	Sample   map[string]string
+	Variants map[string]templateText
+}
+
+var appointmentVars = []string{"patient_name", "doctor_name", "specialty", "date", "time", "clinic_name", "clinic_address"}
+
+var appointmentSample = map[string]string{
+	"patient_name":   "Иван Петров",
+	"doctor_name":    "Анна Смирнова",
+	"specialty":      "терапевт",
+	"date":           "12.03.2026",
+	"time":           "14:30",
+	"clinic_name":    "Клиника на Лесной",
+	"clinic_address": "ул. Лесная, 5",
+}
+
+var builtinTemplates = map[string]templateDef{
+	tplBookingConfirmation: {
+		Vars:   appointmentVars,
+		Sample: appointmentSample,
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Вы записаны на приём",
+				Body:    "{{patient_name}}, вы записаны на приём к врачу {{doctor_name}} ({{specialty}}) {{date}} в {{time}}. {{clinic_name}}, {{clinic_address}}.",
+			},
+			"en": {
+				Subject: "Your appointment is booked",
+				Body:    "{{patient_name}}, your appointment with {{doctor_name}} ({{specialty}}) is booked for {{date}} at {{time}}. {{clinic_name}}, {{clinic_address}}.",
+			},
+		},
+	},
+	tplAppointmentReminder: {
+		Vars:   appointmentVars,
+		Sample: appointmentSample,
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Напоминание о приёме",
+				Body:    "Напоминание: {{date}} в {{time}} приём у врача {{doctor_name}} ({{specialty}}), {{clinic_name}}, {{clinic_address}}.",
+			},
+			"en": {
+				Subject: "Appointment reminder",
+				Body:    "Reminder: your appointment with {{doctor_name}} ({{specialty}}) is on {{date}} at {{time}}, {{clinic_name}}, {{clinic_address}}.",
+			},
+		},
+	},
+	tplAppointmentCancelled: {
+		Vars: []string{"patient_name", "doctor_name", "date", "time", "clinic_name", "reason"},
+		Sample: map[string]string{
+			"patient_name": "Иван Петров",
+			"doctor_name":  "Анна Смирнова",
+			"date":         "12.03.2026",
+			"time":         "14:30",
+			"clinic_name":  "Клиника на Лесной",
+			"reason":       "врач заболел",
+		},
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Приём отменён",
+				Body:    "{{patient_name}}, ваш приём у врача {{doctor_name}} {{date}} в {{time}} ({{clinic_name}}) отменён. Причина: {{reason}}.",
+			},
+			"en": {
+				Subject: "Appointment cancelled",
+				Body:    "{{patient_name}}, your appointment with {{doctor_name}} on {{date}} at {{time}} ({{clinic_name}}) has been cancelled. Reason: {{reason}}.",
+			},
+		},
+	},
+	tplAppointmentRescheduled: {
+		Vars: append(slices.Clone(appointmentVars), "previous_date", "previous_time"),
+		Sample: map[string]string{
+			"patient_name":   "Иван Петров",
+			"doctor_name":    "Анна Смирнова",
+			"specialty":      "терапевт",
+			"date":           "14.03.2026",
+			"time":           "10:00",
+			"clinic_name":    "Клиника на Лесной",
+			"clinic_address": "ул. Лесная, 5",
+			"previous_date":  "12.03.2026",
+			"previous_time":  "14:30",
+		},
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Приём перенесён",
+				Body:    "{{patient_name}}, ваш приём у врача {{doctor_name}} ({{specialty}}) перенесён с {{previous_date}} {{previous_time}} на {{date}} в {{time}}. {{clinic_name}}, {{clinic_address}}.",
+			},
+			"en": {
+				Subject: "Appointment rescheduled",
+				Body:    "{{patient_name}}, your appointment with {{doctor_name}} ({{specialty}}) has been moved from {{previous_date}} {{previous_time}} to {{date}} at {{time}}. {{clinic_name}}, {{clinic_address}}.",
+			},
+		},
+	},
+	tplPaymentReceipt: {
+		Vars: []string{"patient_name", "receipt_number", "amount", "currency", "clinic_name", "date"},
+		Sample: map[string]string{
+			"patient_name":   "Иван Петров",
+			"receipt_number": "3-2026-000042",
+			"amount":         "1500.00",
+			"currency":       "RUB",
+			"clinic_name":    "Клиника на Лесной",
+			"date":           "12.03.2026",
+		},
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Чек об оплате № {{receipt_number}}",
+				Body:    "{{patient_name}}, оплата {{amount}} {{currency}} в «{{clinic_name}}» от {{date}} получена. Чек № {{receipt_number}}.",
+			},
+			"en": {
+				Subject: "Payment receipt No. {{receipt_number}}",
+				Body:    "{{patient_name}}, we have received your payment of {{amount}} {{currency}} to {{clinic_name}} on {{date}}. Receipt No. {{receipt_number}}.",
+			},
+		},
+	},
+	tplWaitlistOffer: {
+		Vars: append(slices.Clone(appointmentVars), "expires_at"),
+		Sample: map[string]string{
+			"patient_name":   "Иван Петров",
+			"doctor_name":    "Анна Смирнова",
+			"specialty":      "терапевт",
+			"date":           "12.03.2026",
+			"time":           "14:30",
+			"clinic_name":    "Клиника на Лесной",
+			"clinic_address": "ул. Лесная, 5",
+			"expires_at":     "11.03.2026 18:00",
+		},
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Освободилось время у врача",
+				Body:    "{{patient_name}}, освободилось время у врача {{doctor_name}} ({{specialty}}): {{date}} в {{time}}, {{clinic_name}}. Мы придержали его для вас до {{expires_at}} — подтвердите запись в листе ожидания.",
+			},
+			"en": {
+				Subject: "A slot with your doctor is available",
+				Body:    "{{patient_name}}, a slot with {{doctor_name}} ({{specialty}}) is available on {{date}} at {{time}}, {{clinic_name}}. We are holding it for you until {{expires_at}} — confirm the booking in your waitlist.",
+			},
+		},
+	},
+	tplPasswordReset: {
+		Vars: []string{"user_name", "reset_link", "expires_minutes"},
+		Sample: map[string]string{
+			"user_name":       "Иван Петров",
+			"reset_link":      "https://clinic.example/reset?token=…",
+			"expires_minutes": "30",
+		},
+		Variants: map[string]templateText{
+			"ru": {
+				Subject: "Восстановление пароля",
+				Body:    "{{user_name}}, чтобы задать новый пароль, перейдите по ссылке {{reset_link}}. Ссылка действует {{expires_minutes}} мин. Если вы не запрашивали сброс, просто проигнорируйте это письмо.",
+			},
+			"en": {
+				Subject: "Password reset",
+				Body:    "{{user_name}}, follow {{reset_link}} to set a new password. The link is valid for {{expires_minutes}} minutes. If you did not request a reset, ignore this message.",
+			},
+		},
+	},
+}
+
+var (
+	errUnknownTemplate = errors.New("неизвестный шаблон")
+	errUnknownLanguage = errors.New("неподдерживаемый язык")
+)
+
+// placeholderRe — подстановка вида {{name}}
+var placeholderRe = regexp.MustCompile(`\{\{\s*([a-z_]+)\s*\}\}`)
+
+func validLanguage(lang string) error {
+	if !slices.Contains(supportedLanguages, lang) {
+		return fmt.Errorf("%w: %q", errUnknownLanguage, lang)
+	}
+	return nil
+}
+
+// checkPlaceholders проверяет, что текст использует только подстановки шаблона
+func (def templateDef) checkPlaceholders(text string) error {
+	for _, m := range placeholderRe.FindAllStringSubmatch(text, -1) {
+		if !slices.Contains(def.Vars, m[1]) {
+			return fmt.Errorf("подстановка {{%s}} не поддерживается, доступны: %s", m[1], strings.Join(def.Vars, ", "))
+		}
+	}
+	return nil
+}
+
+// render подставляет данные; отсутствующие значения заменяются пустой строкой
+func (t templateText) render(data map[string]string) templateText {
+	fill := func(s string) string {
+		return placeholderRe.ReplaceAllStringFunc(s, func(ph string) string {
+			return data[placeholderRe.FindStringSubmatch(ph)[1]]
+		})
+	}
+	return templateText{Subject: fill(t.Subject), Body: fill(t.Body)}
+}
+
+// resolveTemplate выбирает текст шаблона: переопределение клиники, затем
+// системное переопределение, затем встроенный текст. Если для языка нет
+// ни одного варианта, берётся язык по умолчанию.
+func resolveTemplate(q queryRower, name, lang string, clinicID *int) (templateText, error) {
+	def, ok := builtinTemplates[name]
+	if !ok {
+		return templateText{}, fmt.Errorf("%w: %q", errUnknownTemplate, name)
+	}
+	if validLanguage(lang) != nil {
+		lang = defaultLanguage
+	}
+
+	var t templateText
+	err := q.QueryRow(`
+		SELECT subject, body FROM notification_templates
+		WHERE name = $1 AND language = $2 AND (clinic_id = $3 OR clinic_id IS NULL)
+		ORDER BY clinic_id NULLS LAST
+		LIMIT 1`, name, lang, clinicID).Scan(&t.Subject, &t.Body)
+	if err == nil {
+		return t, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return templateText{}, err
+	}
+	if t, ok := def.Variants[lang]; ok {
+		return t, nil
+	}
+	return def.Variants[defaultLanguage], nil
+}
+
+// renderTemplate — resolveTemplate с подстановкой данных
+func renderTemplate(q queryRower, name, lang string, clinicID *int, data map[string]string) (templateText, error) {
+	t, err := resolveTemplate(q, name, lang, clinicID)
+	if err != nil {
+		return templateText{}, err
+	}
+	return t.render(data), nil
+}
+
+// userLanguage — язык из настроек пользователя или язык по умолчанию
+func userLanguage(q queryRower, userID int) (string, error) {
+	var lang string
+	err := q.QueryRow(`SELECT language FROM notification_preferences WHERE user_id = $1`, userID).Scan(&lang)
+	if errors.Is(err, sql.ErrNoRows) {
+		return defaultLanguage, nil
+	}
+	return lang, err
+}
+
+// TemplateInfo — действующий текст шаблона для клиники и языка
+type TemplateInfo struct {
+	Name     string   `json:"name"`
+	Language string   `json:"language"`
+	ClinicID *int     `json:"clinic_id"`
+	Vars     []string `json:"vars"`
+	// Source: builtin, system или clinic — откуда взят текст
+	Source string `json:"source"`
+	templateText
+}
+
+// listTemplates возвращает все шаблоны на всех языках, как их увидит клиника clinicID
+func listTemplates(db *sql.DB, clinicID *int) ([]TemplateInfo, error) {
+	type key struct{ name, lang string }
+	overrides := map[key]TemplateInfo{}
+	rows, err := db.Query(`
+		SELECT name, language, clinic_id, subject, body FROM notification_templates
+		WHERE clinic_id IS NULL OR clinic_id = $1
+		ORDER BY clinic_id NULLS FIRST`, clinicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t TemplateInfo
+		if err := rows.Scan(&t.Name, &t.Language, &t.ClinicID, &t.Subject, &t.Body); err != nil {
+			return nil, err
+		}
+		t.Source = "system"
+		if t.ClinicID != nil {
+			t.Source = "clinic"
+		}
+		// Строки клиники идут после системных и перекрывают их
+		overrides[key{t.Name, t.Language}] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(builtinTemplates))
+	for name := range builtinTemplates {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	list := []TemplateInfo{}
+	for _, name := range names {
+		def := builtinTemplates[name]
+		for _, lang := range supportedLanguages {
+			t, ok := overrides[key{name, lang}]
+			if !ok {
+				t = TemplateInfo{Name: name, Language: lang, Source: "builtin", templateText: def.Variants[lang]}
+			}
+			t.Vars = def.Vars
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+// saveTemplate создаёт или меняет переопределение шаблона
+func saveTemplate(db *sql.DB, name, lang string, clinicID *int, t templateText, updatedBy int) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_templates (name, language, clinic_id, subject, body, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name, language, (COALESCE(clinic_id, 0))) DO UPDATE SET
+			subject = EXCLUDED.subject, body = EXCLUDED.body,
+			updated_by = EXCLUDED.updated_by, updated_at = NOW()`,
+		name, lang, clinicID, t.Subject, t.Body, updatedBy)
+	return err
+}
+
+// deleteTemplate удаляет переопределение — снова действует системный или встроенный текст
+func deleteTemplate(db *sql.DB, name, lang string, clinicID *int) (bool, error) {
+	res, err := db.Exec(`
+		DELETE FROM notification_templates
+		WHERE name = $1 AND language = $2 AND clinic_id IS NOT DISTINCT FROM $3`, name, lang, clinicID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// optionalClinicID разбирает необязательный ?clinic_id=. При ошибке сам отвечает клиенту.
+func optionalClinicID(c *gin.Context) (*int, bool) {
+	s := c.Query("clinic_id")
+	if s == "" {
+		return nil, true
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "неверный clinic_id"})
+		return nil, false
+	}
+	return &id, true
+}
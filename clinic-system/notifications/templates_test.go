@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestTemplateRender(t *testing.T) {
+	tests := []struct {
+		text string
+		data map[string]string
+		want string
+	}{
+		{"{{a}} и {{b}}", map[string]string{"a": "1", "b": "2"}, "1 и 2"},
+		{"{{ a }}", map[string]string{"a": "1"}, "1"},
+		{"нет {{missing}}", nil, "нет "},
+		{"{{a}}{{a}}", map[string]string{"a": "x"}, "xx"},
+		// Значения не рендерятся повторно
+		{"{{a}}", map[string]string{"a": "{{b}}", "b": "нельзя"}, "{{b}}"},
+		// Не подстановки остаются как есть
+		{"{{A}} {a} {{ }}", map[string]string{"a": "1"}, "{{A}} {a} {{ }}"},
+	}
+	for _, tt := range tests {
+		got := templateText{Subject: tt.text, Body: tt.text}.render(tt.data)
+		if got.Subject != tt.want || got.Body != tt.want {
+			t.Errorf("render(%q) = %+v, ожидалось %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPlaceholders(t *testing.T) {
+	def := builtinTemplates[tplPaymentReceipt]
+	if err := def.checkPlaceholders("Чек {{receipt_number}} на {{ amount }} {{currency}}"); err != nil {
+		t.Errorf("допустимые подстановки отклонены: %v", err)
+	}
+	if err := def.checkPlaceholders("{{doctor_name}}"); err == nil {
+		t.Error("подстановка чужого шаблона принята")
+	}
+	// Все встроенные тексты используют только свои подстановки
+	for name, def := range builtinTemplates {
+		for lang, v := range def.Variants {
+			if err := def.checkPlaceholders(v.Subject + v.Body); err != nil {
+				t.Errorf("%s/%s: %v", name, lang, err)
+			}
+		}
+		for _, lang := range supportedLanguages {
+			if _, ok := def.Variants[lang]; !ok {
+				t.Errorf("%s: нет текста на %s", name, lang)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Роли пользователей из таблицы users
+const (
+	rolePatient     = "patient"
+	roleDoctor      = "doctor"
+	roleClinicAdmin = "clinic_admin"
+	roleAdmin       = "admin"
+)
+
+// caller — пользователь, от имени которого пришёл запрос (X-User-ID gateway берёт из JWT)
+type caller struct {
+	ID       int
+	Role     string
+	ClinicID *int
+}
+
+var errNoCaller = errors.New("не указан X-User-ID")
+
+func loadCaller(db *sql.DB, c *gin.Context) (*caller, error) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil {
+		return nil, errNoCaller
+	}
+	u := caller{ID: id}
+	err = db.QueryRow(`SELECT role, clinic_id FROM users WHERE id = $1`, id).Scan(&u.Role, &u.ClinicID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoCaller
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// requireCaller — loadCaller, который сам отвечает клиенту при ошибке
+func requireCaller(db *sql.DB, c *gin.Context) (*caller, bool) {
+	u, err := loadCaller(db, c)
+	if errors.Is(err, errNoCaller) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке пользователя"})
+		return nil, false
+	}
+	return u, true
+}
+
+// managesClinic — администратор этой клиники или администратор системы
+func (u *caller) managesClinic(clinicID int) bool {
+	return u.Role == roleAdmin || (u.Role == roleClinicAdmin && u.ClinicID != nil && *u.ClinicID == clinicID)
+}
+
+// isClinicStaff — врач или администратор клиники
+func (u *caller) isClinicStaff(clinicID int) bool {
+	return (u.Role == roleDoctor || u.Role == roleClinicAdmin) && u.ClinicID != nil && *u.ClinicID == clinicID
+}
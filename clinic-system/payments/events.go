@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"eventbus"
+)
+
+// publishPayment публикует событие о платеже в транзакции tx.
+// refundMinor — сумма возврата для payment.refunded, иначе 0.
+func publishPayment(ctx context.Context, tx *sql.Tx, topic string, paymentID int, refundMinor int64) error {
+	ev := eventbus.Payment{PaymentID: paymentID, RefundMinor: refundMinor}
+	err := tx.QueryRowContext(ctx, `
+		SELECT appointment_id, amount_minor, currency, payment_status FROM payments WHERE id = $1`, paymentID).
+		Scan(&ev.AppointmentID, &ev.AmountMinor, &ev.Currency, &ev.Status)
+	if err != nil {
+		return err
+	}
+	return eventbus.Publish(ctx, tx, topic, ev)
+}
+
+// eventConsumer подписывает сервис на события: оплата — выдать чек,
+// отмена приёма — вернуть деньги. Периодический обход отмен остаётся
+// страховкой на случай, если событие долго не доходит.
+func eventConsumer(db *sql.DB, dsn string, provider PaymentProvider, policy refundPolicy) *eventbus.Consumer {
+	c := eventbus.NewConsumer(db, dsn, "payments")
+	c.Handle(eventbus.PaymentSucceeded, func(ctx context.Context, ev eventbus.Event) error {
+		var p eventbus.Payment
+		if err := ev.Decode(&p); err != nil {
+			return err
+		}
+		_, err := issueReceipt(ctx, db, p.PaymentID)
+		if errors.Is(err, errNotPaid) {
+			return nil
+		}
+		return err
+	})
+	c.Handle(eventbus.AppointmentCancelled, func(ctx context.Context, ev eventbus.Event) error {
+		return processCancellations(ctx, db, provider, policy)
+	})
+	return c
+}
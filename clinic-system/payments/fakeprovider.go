@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeProvider — платёжный шлюз для локальной разработки и тестов.
+// Платежи хранятся в таблице fake_provider_intents, чтобы переживать
+// перезапуск сервиса. «Оплата» делается переходом по ссылке
+// /fake-provider/checkout/:intent?outcome=success|fail, после чего провайдер
+// присылает подписанный вебхук, как настоящий.
+type fakeProvider struct {
+	db         *sql.DB
+	secret     []byte
+	baseURL    string
+	webhookURL string
+	client     *http.Client
+}
+
+// Статусы платежа у тестового провайдера
+const (
+	fakeCreated    = "created"
+	fakeAuthorized = "authorized"
+	fakeCaptured   = "captured"
+	fakeFailed     = "failed"
+)
+
+func newFakeProviderFromEnv(db *sql.DB) (*fakeProvider, error) {
+	p := &fakeProvider{
+		db:         db,
+		secret:     []byte(os.Getenv("FAKE_PROVIDER_SECRET")),
+		baseURL:    os.Getenv("FAKE_PROVIDER_BASE_URL"),
+		webhookURL: os.Getenv("FAKE_PROVIDER_WEBHOOK_URL"),
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+	if len(p.secret) == 0 {
+		return nil, errors.New("не задан FAKE_PROVIDER_SECRET")
+	}
+	if p.baseURL == "" {
+		p.baseURL = "http://localhost:8000/api/payments"
+	}
+	if p.webhookURL == "" {
+		p.webhookURL = "http://localhost:8085/webhooks/fake"
+	}
+	return p, nil
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	id := "fake_" + token
+	if _, err := p.db.ExecContext(ctx, `
+		INSERT INTO fake_provider_intents (id, amount_minor, status) VALUES ($1, $2, $3)`,
+		id, req.Amount.Minor, fakeCreated); err != nil {
+		return nil, err
+	}
+	return &Intent{ID: id, ConfirmationURL: p.baseURL + "/fake-provider/checkout/" + id}, nil
+}
+
+// intentStatus — статус платежа; неизвестный платёж — ошибка
+func (p *fakeProvider) intentStatus(ctx context.Context, intentID string) (string, error) {
+	var status string
+	err := p.db.QueryRowContext(ctx, `SELECT status FROM fake_provider_intents WHERE id = $1`, intentID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("fake: платёж %s не найден", intentID)
+	}
+	return status, err
+}
+
+func (p *fakeProvider) Capture(ctx context.Context, intentID string) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE fake_provider_intents SET status = $2
+		WHERE id = $1 AND status IN ($3, $2)`, intentID, fakeCaptured, fakeAuthorized)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	status, err := p.intentStatus(ctx, intentID)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("fake: платёж %s в статусе %s нельзя списать", intentID, status)
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, intentID string, amount Money) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE fake_provider_intents SET refunded_minor = refunded_minor + $2
+		WHERE id = $1 AND status = $3 AND $2 > 0 AND refunded_minor + $2 <= amount_minor`,
+		intentID, amount.Minor, fakeCaptured)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return "fake_refund_" + token, nil
+	}
+	status, err := p.intentStatus(ctx, intentID)
+	if err != nil {
+		return "", err
+	}
+	if status != fakeCaptured {
+		return "", fmt.Errorf("fake: платёж %s не списан", intentID)
+	}
+	return "", fmt.Errorf("fake: сумма возврата превышает остаток")
+}
+
+func (p *fakeProvider) VerifyWebhook(header http.Header, body []byte) (*WebhookEvent, error) {
+	sig, err := hex.DecodeString(header.Get("X-Fake-Signature"))
+	if err != nil || !hmac.Equal(sig, p.sign(body)) {
+		return nil, errBadSignature
+	}
+	var ev WebhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return nil, err
+	}
+	if ev.ID == "" || ev.IntentID == "" {
+		return nil, errors.New("в вебхуке нет id или intent_id")
+	}
+	return &ev, nil
+}
+
+func (p *fakeProvider) sign(body []byte) []byte {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// registerRoutes добавляет страницу «оплаты» фейкового провайдера
+func (p *fakeProvider) registerRoutes(r *gin.Engine) {
+	r.GET("/fake-provider/checkout/:intent", func(c *gin.Context) {
+		id := c.Param("intent")
+		outcome := c.DefaultQuery("outcome", "success")
+
+		next := fakeAuthorized
+		if outcome != "success" {
+			next = fakeFailed
+		}
+		if _, err := p.db.ExecContext(c.Request.Context(), `
+			UPDATE fake_provider_intents SET status = $2 WHERE id = $1 AND status = $3`, id, next, fakeCreated); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+		if _, err := p.intentStatus(c.Request.Context(), id); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "платёж не найден"})
+			return
+		}
+		token, err := randomToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось создать событие"})
+			return
+		}
+
+		event := eventPaymentAuthorized
+		if outcome != "success" {
+			event = eventPaymentFailed
+		}
+		go p.sendWebhook(WebhookEvent{ID: "evt_" + token, Type: event, IntentID: id})
+		c.JSON(http.StatusOK, gin.H{"intent": id, "event": event})
+	})
+}
+
+// sendWebhook доставляет событие с повторами, как это делают реальные провайдеры
+func (p *fakeProvider) sendWebhook(ev WebhookEvent) {
+	body, _ := json.Marshal(ev)
+	for attempt := 1; attempt <= 5; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, p.webhookURL, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("fake: вебхук %s: %v", ev.ID, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Fake-Signature", hex.EncodeToString(p.sign(body)))
+
+		resp, err := p.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("ответ %s", resp.Status)
+		}
+		log.Printf("fake: вебхук %s, попытка %d: %v", ev.ID, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
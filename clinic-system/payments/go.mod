@@ -3,7 +3,9 @@ module payments
 go 1.24.1
 
 require (
+	eventbus v0.0.0
 	github.com/gin-gonic/gin v1.10.0
+	github.com/jung-kurt/gofpdf v1.16.2
 	github.com/lib/pq v1.10.9
 )
 
@@ -35,3 +37,5 @@ require (
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace eventbus => ../eventbus
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// paymentFilter — параметры выборки GET /payments
+type paymentFilter struct {
+	PatientID *int // только приёмы этого пациента
+	ClinicID  *int // только приёмы врачей этой клиники
+	Statuses  []string
+	From      *time.Time // включительно
+	To        *time.Time // не включительно
+	Limit     int
+	Offset    int
+}
+
+var errForbiddenListing = errors.New("нет доступа к списку платежей")
+
+// parsePaymentFilter разбирает query-параметры и ограничивает выборку ролью:
+// пациент видит свои платежи, администратор клиники — своей клиники,
+// администратор системы — все (с необязательным clinic_id).
+func parsePaymentFilter(c *gin.Context, u *caller) (*paymentFilter, error) {
+	f := paymentFilter{Limit: 20}
+
+	switch u.Role {
+	case rolePatient:
+		f.PatientID = &u.ID
+	case roleClinicAdmin:
+		if u.ClinicID == nil {
+			return nil, errForbiddenListing
+		}
+		f.ClinicID = u.ClinicID
+	case roleAdmin:
+		if s := c.Query("clinic_id"); s != "" {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("неверный clinic_id")
+			}
+			f.ClinicID = &id
+		}
+	default:
+		return nil, errForbiddenListing
+	}
+
+	if s := c.Query("status"); s != "" {
+		for _, st := range strings.Split(s, ",") {
+			if st = strings.TrimSpace(st); st != "" {
+				f.Statuses = append(f.Statuses, st)
+			}
+		}
+	}
+	var err error
+	if f.From, f.To, err = parseDateRange(c); err != nil {
+		return nil, err
+	}
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("limit должен быть от 1 до 100")
+		}
+		f.Limit = n
+	}
+	if s := c.Query("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("неверный offset")
+		}
+		f.Offset = n
+	}
+	return &f, nil
+}
+
+// parseDateRange разбирает ?from=&to= в формате ГГГГ-ММ-ДД. Обе даты
+// включительно, поэтому to сдвигается на сутки вперёд.
+func parseDateRange(c *gin.Context) (from, to *time.Time, err error) {
+	if s := c.Query("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("from должен быть в формате ГГГГ-ММ-ДД")
+		}
+		from = &t
+	}
+	if s := c.Query("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("to должен быть в формате ГГГГ-ММ-ДД")
+		}
+		t = t.AddDate(0, 0, 1)
+		to = &t
+	}
+	return from, to, nil
+}
+
+// queryPayments возвращает страницу платежей и общее число подходящих
+func queryPayments(db *sql.DB, f *paymentFilter) ([]Payment, int, error) {
+	var where []string
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if f.PatientID != nil {
+		where = append(where, "a.user_id = "+arg(*f.PatientID))
+	}
+	if f.ClinicID != nil {
+		where = append(where, "d.clinic_id = "+arg(*f.ClinicID))
+	}
+	if len(f.Statuses) > 0 {
+		where = append(where, "p.payment_status = ANY("+arg(pq.Array(f.Statuses))+")")
+	}
+	if f.From != nil {
+		where = append(where, "p.payment_date >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "p.payment_date < "+arg(*f.To))
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+	from := `
+		FROM payments p
+		JOIN appointments a ON a.id = p.appointment_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		` + cond
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) `+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT p.id, p.appointment_id, p.service, p.amount_minor, p.currency, p.payment_date, p.payment_status,
+		       COALESCE(p.provider, ''), COALESCE(p.confirmation_url, '')
+		`+from+`
+		ORDER BY p.payment_date DESC, p.id DESC
+		LIMIT `+arg(f.Limit)+` OFFSET `+arg(f.Offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	list := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.AppointmentID, &p.Service, &p.Amount.Minor, &p.Amount.Currency, &p.PaymentDate, &p.PaymentStatus,
+			&p.Provider, &p.ConfirmationURL); err != nil {
+			return nil, 0, err
+		}
+		list = append(list, p)
+	}
+	return list, total, rows.Err()
+}
@@ -1,24 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type Payment struct {
-	ID            int       `json:"id"`
-	AppointmentID int       `json:"appointment_id"`
-	Amount        float64   `json:"amount"`
-	PaymentDate   time.Time `json:"payment_date"`
-	PaymentStatus string    `json:"payment_status"`
+	ID              int       `json:"id"`
+	AppointmentID   int       `json:"appointment_id"`
+	Service         string    `json:"service"`
+	Amount          Money     `json:"amount"`
+	PaymentDate     time.Time `json:"payment_date"`
+	PaymentStatus   string    `json:"payment_status"`
+	Provider        string    `json:"provider"`
+	ConfirmationURL string    `json:"confirmation_url,omitempty"`
 }
 
+// Статусы приёма, важные для платежей
+const (
+	appointmentCancelled = "отменён" // отменённый приём оплатить нельзя
+	appointmentCompleted = "завершён"
+)
+
 func main() {
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -31,23 +47,120 @@ func main() {
 	}
 	defer db.Close()
 
+	provider, err := newProviderFromEnv(db)
+	if err != nil {
+		log.Fatal("Ошибка настройки платёжного провайдера:", err)
+	}
+
+	sweep := time.Minute
+	if sec, err := strconv.Atoi(os.Getenv("REFUND_SWEEP_SECONDS")); err == nil && sec > 0 {
+		sweep = time.Duration(sec) * time.Second
+	}
+	policy := refundPolicyFromEnv()
+	go runRefundWorker(db, provider, policy, sweep)
+
+	go func() {
+		if err := eventConsumer(db, dbURL, provider, policy).Run(context.Background()); err != nil {
+			log.Fatal("Ошибка подписки на события:", err)
+		}
+	}()
+
 	r := gin.Default()
+	if fake, ok := provider.(*fakeProvider); ok {
+		fake.registerRoutes(r)
+	}
 
+	// Оплата приёма: сумма берётся из прайс-листа клиники, а не от клиента
 	r.POST("/payments", func(c *gin.Context) {
-		var p Payment
-		if err := c.BindJSON(&p); err != nil {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		var req struct {
+			AppointmentID int    `json:"appointment_id"`
+			Service       string `json:"service"`
+		}
+		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
 			return
 		}
-		p.PaymentDate = time.Now()
-		p.PaymentStatus = "paid"
+		if req.Service == "" {
+			req.Service = defaultService
+		}
+
+		a, err := loadAppointment(db, req.AppointmentID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "приём не найден"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при проверке приёма"})
+			return
+		}
+		if a.PatientID != u.ID && !u.isClinicStaff(a.ClinicID) && u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "нельзя оплатить чужой приём"})
+			return
+		}
+		if a.Status == appointmentCancelled {
+			c.JSON(http.StatusConflict, gin.H{"error": "приём отменён"})
+			return
+		}
+
+		price, err := lookupPrice(db, a.ClinicID, a.Specialty, req.Service)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "для этой услуги в клинике не задана цена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при расчёте стоимости"})
+			return
+		}
 
-		err := db.QueryRow(`
-			INSERT INTO payments (appointment_id, amount, payment_date, payment_status)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id`,
-			p.AppointmentID, p.Amount, p.PaymentDate, p.PaymentStatus,
+		p := Payment{
+			AppointmentID: a.ID,
+			Service:       req.Service,
+			Amount:        price,
+			PaymentDate:   time.Now(),
+			PaymentStatus: paymentPending,
+			Provider:      provider.Name(),
+		}
+		err = db.QueryRow(`
+			WITH created AS (
+				INSERT INTO payments (appointment_id, service, amount_minor, currency, payment_date, payment_status, provider)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)
+				RETURNING id, payment_status
+			)
+			INSERT INTO payment_status_history (payment_id, to_status, reason)
+			SELECT id, payment_status, 'платёж создан' FROM created
+			RETURNING payment_id`,
+			p.AppointmentID, p.Service, p.Amount.Minor, p.Amount.Currency, p.PaymentDate, p.PaymentStatus, p.Provider,
 		).Scan(&p.ID)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "по приёму уже есть платёж"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при создании платежа"})
+			return
+		}
+
+		intent, err := provider.CreateIntent(c.Request.Context(), IntentRequest{
+			PaymentID:   p.ID,
+			Amount:      p.Amount,
+			Description: "Оплата приёма №" + strconv.Itoa(a.ID),
+		})
+		if err != nil {
+			log.Printf("платёж %d: провайдер не создал платёж: %v", p.ID, err)
+			if err := setStatus(db, p.ID, paymentFailed, "провайдер недоступен", paymentPending); err != nil {
+				log.Printf("платёж %d: %v", p.ID, err)
+			}
+			c.JSON(http.StatusBadGateway, gin.H{"error": "платёжный провайдер недоступен"})
+			return
+		}
+		p.ConfirmationURL = intent.ConfirmationURL
+		_, err = db.Exec(`UPDATE payments SET provider_intent_id = $2, confirmation_url = $3 WHERE id = $1`,
+			p.ID, intent.ID, intent.ConfirmationURL)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при создании платежа"})
 			return
@@ -55,26 +168,387 @@ func main() {
 		c.JSON(http.StatusCreated, p)
 	})
 
+	// Уведомления от платёжного провайдера
+	r.POST("/webhooks/:provider", func(c *gin.Context) {
+		if c.Param("provider") != provider.Name() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "неизвестный провайдер"})
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "не удалось прочитать тело"})
+			return
+		}
+		ev, err := provider.VerifyWebhook(c.Request.Header, body)
+		if errors.Is(err, errBadSignature) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "некорректный вебхук"})
+			return
+		}
+
+		duplicate, err := applyWebhook(c.Request.Context(), db, provider, ev)
+		switch {
+		case errors.Is(err, errUnknownIntent):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, errTransition):
+			// Повторять бессмысленно — отвечаем 200, чтобы провайдер не слал снова
+			log.Printf("вебхук %s: %v", ev.ID, err)
+			c.JSON(http.StatusOK, gin.H{"status": "ignored"})
+		case err != nil:
+			// 5xx — провайдер повторит доставку
+			log.Printf("вебхук %s: %v", ev.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось обработать событие"})
+		case duplicate:
+			c.JSON(http.StatusOK, gin.H{"status": "duplicate"})
+		default:
+			c.JSON(http.StatusOK, gin.H{"status": "processed"})
+		}
+	})
+
+	// Список платежей в пределах роли: ?status=succeeded,refunded&from=&to=&limit=&offset=
+	// Общее число подходящих платежей — в заголовке X-Total-Count.
 	r.GET("/payments", func(c *gin.Context) {
-		// Если пациент хочет увидеть свои оплаты, можно привязать appointment->user_id,
-		// но упрощённо выведем все платежи
-		rows, err := db.Query(`SELECT id, appointment_id, amount, payment_date, payment_status FROM payments`)
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		f, err := parsePaymentFilter(c, u)
+		if errors.Is(err, errForbiddenListing) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		list, total, err := queryPayments(db, f)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении данных"})
 			return
 		}
-		defer rows.Close()
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		c.JSON(http.StatusOK, list)
+	})
 
-		var list []Payment
-		for rows.Next() {
-			var p Payment
-			if err := rows.Scan(&p.ID, &p.AppointmentID, &p.Amount, &p.PaymentDate, &p.PaymentStatus); err == nil {
-				list = append(list, p)
+	// Возврат по платежу: полный (amount не указан) или частичный, с причиной
+	r.POST("/payments/:id/refunds", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		paymentID, a, ok := loadPaymentAppointment(db, c)
+		if !ok {
+			return
+		}
+		if !u.managesClinic(a.ClinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "возврат оформляет администратор клиники"})
+			return
+		}
+		var req struct {
+			Amount decimalInput `json:"amount"`
+			Reason string       `json:"reason"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "укажите причину возврата"})
+			return
+		}
+		// Сумма указывается в валюте платежа; без суммы возвращается весь остаток
+		var amount Money
+		if req.Amount != "" {
+			var currency string
+			if err := db.QueryRow(`SELECT currency FROM payments WHERE id = $1`, paymentID).Scan(&currency); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+				return
+			}
+			var err error
+			if amount, err = parseMoney(string(req.Amount), currency); err != nil || amount.Minor == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "некорректная сумма возврата"})
+				return
 			}
 		}
+
+		rf, err := refundPayment(c.Request.Context(), db, provider, paymentID, amount.Minor, req.Reason, &u.ID)
+		switch {
+		case errors.Is(err, errNotRefundable):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, errRefundAmount):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, errRefundFailed):
+			log.Printf("возврат по платежу %d: %v", paymentID, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "провайдер отклонил возврат"})
+		case err != nil:
+			log.Printf("возврат по платежу %d: %v", paymentID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось выполнить возврат"})
+		default:
+			c.JSON(http.StatusCreated, rf)
+		}
+	})
+
+	// Возвраты по платежу
+	r.GET("/payments/:id/refunds", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		paymentID, a, ok := loadPaymentAppointment(db, c)
+		if !ok {
+			return
+		}
+		if a.PatientID != u.ID && !u.isClinicStaff(a.ClinicID) && u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "нет доступа к платежу"})
+			return
+		}
+		list, err := listRefunds(db, paymentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении возвратов"})
+			return
+		}
 		c.JSON(http.StatusOK, list)
 	})
 
+	// История статусов платежа
+	r.GET("/payments/:id/history", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		paymentID, a, ok := loadPaymentAppointment(db, c)
+		if !ok {
+			return
+		}
+		if a.PatientID != u.ID && !u.isClinicStaff(a.ClinicID) && u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "нет доступа к платежу"})
+			return
+		}
+		list, err := listStatusHistory(db, paymentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении истории"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	// Чек по оплате: JSON или ?format=pdf
+	r.GET("/payments/:id/receipt", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		paymentID, a, ok := loadPaymentAppointment(db, c)
+		if !ok {
+			return
+		}
+		if a.PatientID != u.ID && !u.isClinicStaff(a.ClinicID) && u.Role != roleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "нет доступа к платежу"})
+			return
+		}
+
+		rc, err := issueReceipt(c.Request.Context(), db, paymentID)
+		if errors.Is(err, errNotPaid) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("чек по платежу %d: %v", paymentID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось получить чек"})
+			return
+		}
+
+		switch c.DefaultQuery("format", "json") {
+		case "json":
+			c.JSON(http.StatusOK, rc)
+		case "pdf":
+			var buf bytes.Buffer
+			if err := writeReceiptPDF(&buf, rc); err != nil {
+				log.Printf("PDF чека %s: %v", rc.Number, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сформировать PDF"})
+				return
+			}
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="receipt-%s.pdf"`, rc.Number))
+			c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format должен быть json или pdf"})
+		}
+	})
+
+	// Выручка: ?group_by=clinic|doctor|specialty&period=day|week|month&from=&to=&format=json|csv
+	r.GET("/reports/revenue", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		f, err := parseReportFilter(c, u)
+		if errors.Is(err, errForbiddenReport) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		rows, err := queryRevenue(db, f)
+		if err != nil {
+			log.Printf("отчёт о выручке: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при построении отчёта"})
+			return
+		}
+		switch c.DefaultQuery("format", "json") {
+		case "json":
+			c.JSON(http.StatusOK, gin.H{"rows": rows, "totals": revenueTotals(rows)})
+		case "csv":
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", `attachment; filename="revenue.csv"`)
+			if err := writeRevenueCSV(c.Writer, rows); err != nil {
+				log.Printf("CSV выручки: %v", err)
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format должен быть json или csv"})
+		}
+	})
+
+	// Завершённые, но не оплаченные приёмы: ?from=&to=&format=json|csv
+	r.GET("/reports/outstanding", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		f, err := parseReportFilter(c, u)
+		if errors.Is(err, errForbiddenReport) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		items, err := queryOutstanding(db, f)
+		if err != nil {
+			log.Printf("отчёт о неоплаченных приёмах: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при построении отчёта"})
+			return
+		}
+		switch c.DefaultQuery("format", "json") {
+		case "json":
+			c.JSON(http.StatusOK, gin.H{"items": items, "count": len(items), "totals": outstandingTotals(items)})
+		case "csv":
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", `attachment; filename="outstanding.csv"`)
+			if err := writeOutstandingCSV(c.Writer, items); err != nil {
+				log.Printf("CSV неоплаченных приёмов: %v", err)
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format должен быть json или csv"})
+		}
+	})
+
+	// Прайс-лист клиники
+	r.GET("/prices", func(c *gin.Context) {
+		clinicID, err := strconv.Atoi(c.Query("clinic_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "не указан clinic_id"})
+			return
+		}
+		list, err := listPrices(db, clinicID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при получении прайс-листа"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	})
+
+	// Задать цену услуги (администратор клиники)
+	r.PUT("/prices", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		var req struct {
+			ClinicID  int          `json:"clinic_id"`
+			Specialty string       `json:"specialty"`
+			Service   string       `json:"service"`
+			Price     decimalInput `json:"price"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неправильный запрос"})
+			return
+		}
+		p := PriceItem{
+			ClinicID:  req.ClinicID,
+			Specialty: strings.TrimSpace(req.Specialty),
+			Service:   strings.TrimSpace(req.Service),
+		}
+		if p.Service == "" {
+			p.Service = defaultService
+		}
+		if !u.managesClinic(p.ClinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "менять цены может только администратор клиники"})
+			return
+		}
+
+		// Цена задаётся в валюте клиники, например "1500" или "1500.50"
+		currency, err := clinicCurrency(db, p.ClinicID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "клиника не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+		if p.Price, err = parseMoney(string(req.Price), currency); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "цена должна быть неотрицательным числом с точностью до минимальной единицы валюты"})
+			return
+		}
+
+		if err := upsertPrice(db, &p); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось сохранить цену"})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	})
+
+	// Удалить строку прайса
+	r.DELETE("/prices/:id", func(c *gin.Context) {
+		u, ok := requireCaller(db, c)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID"})
+			return
+		}
+		var clinicID int
+		err = db.QueryRow(`SELECT clinic_id FROM price_list WHERE id = $1`, id).Scan(&clinicID)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "цена не найдена"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+			return
+		}
+		if !u.managesClinic(clinicID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "менять цены может только администратор клиники"})
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM price_list WHERE id = $1`, id); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "не удалось удалить цену"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
 	if err := r.Run(":8085"); err != nil {
 		log.Fatal("Ошибка запуска payments сервиса:", err)
 	}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money — сумма в минорных единицах валюты (копейки, центы) с кодом ISO 4217.
+// Арифметика только целочисленная; десятичная запись нужна лишь для ввода и вывода.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// currencyExponents — число знаков после запятой у поддерживаемых валют
+var currencyExponents = map[string]int{
+	"RUB": 2,
+	"BYN": 2,
+	"KZT": 2,
+	"UZS": 2,
+	"KGS": 2,
+	"AMD": 2,
+	"GEL": 2,
+	"USD": 2,
+	"EUR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+}
+
+var (
+	errCurrency = errors.New("неподдерживаемая валюта")
+	errAmount   = errors.New("некорректная сумма")
+)
+
+func currencyExponent(code string) (int, error) {
+	exp, ok := currencyExponents[code]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", errCurrency, code)
+	}
+	return exp, nil
+}
+
+// parseMoney разбирает десятичную запись вроде "1500" или "1500.50" в валюте
+// currency. Лишние знаки после запятой — ошибка, а не округление.
+func parseMoney(s, currency string) (Money, error) {
+	exp, err := currencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if whole == "" || len(frac) > exp || strings.ContainsAny(whole, "+-") {
+		return Money{}, errAmount
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, errAmount
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// String — десятичная запись без кода валюты: "1500.50"
+func (m Money) String() string {
+	exp := currencyExponents[m.Currency]
+	sign, v := "", m.Minor
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(v, 10)
+	}
+	div := int64(math.Pow10(exp))
+	return fmt.Sprintf("%s%d.%0*d", sign, v/div, exp, v%div)
+}
+
+// MarshalJSON отдаёт сумму и точным целым, и десятичной строкой для показа
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Minor    int64  `json:"minor"`
+		Value    string `json:"value"`
+		Currency string `json:"currency"`
+	}{m.Minor, m.String(), m.Currency})
+}
+
+// decimalInput — сумма во входящем JSON. Принимает и число, и строку,
+// сохраняя запись как есть, чтобы не терять точность на float64.
+type decimalInput string
+
+func (d *decimalInput) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		*d = ""
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*d = decimalInput(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return errAmount
+	}
+	*d = decimalInput(n.String())
+	return nil
+}
+
+// percentOf — pct процентов от суммы с округлением до минорной единицы
+func percentOf(m Money, pct int64) Money {
+	return Money{Minor: divRound(m.Minor*pct, 100), Currency: m.Currency}
+}
+
+// divRound делит неотрицательные a и b с округлением половины вверх
+func divRound(a, b int64) int64 {
+	return (2*a + b) / (2 * b)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency string
+		want     int64
+		err      error
+	}{
+		{"1500", "RUB", 150000, nil},
+		{"1500.5", "RUB", 150050, nil},
+		{"1500.50", "RUB", 150050, nil},
+		{"0.01", "RUB", 1, nil},
+		{" 12.30 ", "USD", 1230, nil},
+		{"1.", "RUB", 100, nil},
+		{"0", "RUB", 0, nil},
+		{"1500", "JPY", 1500, nil},
+		{"1.234", "KWD", 1234, nil},
+		{"1.5", "JPY", 0, errAmount},
+		{"1500.505", "RUB", 0, errAmount},
+		{".50", "RUB", 0, errAmount},
+		{"", "RUB", 0, errAmount},
+		{"-5", "RUB", 0, errAmount},
+		{"+5", "RUB", 0, errAmount},
+		{"1e3", "RUB", 0, errAmount},
+		{"1.2.3", "KWD", 0, errAmount},
+		{"12,50", "RUB", 0, errAmount},
+		{"99999999999999999999", "RUB", 0, errAmount},
+		{"10", "XXX", 0, errCurrency},
+	}
+	for _, tt := range tests {
+		got, err := parseMoney(tt.in, tt.currency)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("parseMoney(%q, %s): ошибка %v, ожидалась %v", tt.in, tt.currency, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMoney(%q, %s): %v", tt.in, tt.currency, err)
+			continue
+		}
+		if got.Minor != tt.want || got.Currency != tt.currency {
+			t.Errorf("parseMoney(%q, %s) = %+v, ожидалось %d %s", tt.in, tt.currency, got, tt.want, tt.currency)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{Money{150050, "RUB"}, "1500.50"},
+		{Money{5, "RUB"}, "0.05"},
+		{Money{-120, "USD"}, "-1.20"},
+		{Money{1500, "JPY"}, "1500"},
+		{Money{1234, "KWD"}, "1.234"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, ожидалось %q", tt.m, got, tt.want)
+		}
+		// Что выводим, то и должны уметь принять обратно
+		if tt.m.Minor >= 0 {
+			back, err := parseMoney(tt.m.String(), tt.m.Currency)
+			if err != nil || back != tt.m {
+				t.Errorf("parseMoney(%q) = %+v, %v, ожидалось %+v", tt.m.String(), back, err, tt.m)
+			}
+		}
+	}
+}
+
+func TestDecimalInput(t *testing.T) {
+	tests := []struct {
+		in   string
+		want decimalInput
+		ok   bool
+	}{
+		{`1500.50`, "1500.50", true},
+		{`"1500.50"`, "1500.50", true},
+		{`0.1`, "0.1", true},
+		{`null`, "", true},
+		{`true`, "", false},
+	}
+	for _, tt := range tests {
+		var d decimalInput
+		err := json.Unmarshal([]byte(tt.in), &d)
+		if (err == nil) != tt.ok || d != tt.want {
+			t.Errorf("decimalInput(%s) = %q, %v", tt.in, d, err)
+		}
+	}
+}
+
+func TestPercentOf(t *testing.T) {
+	tests := []struct {
+		minor int64
+		pct   int64
+		want  int64
+	}{
+		{10000, 50, 5000},
+		{10000, 0, 0},
+		{10000, 100, 10000},
+		{333, 50, 167}, // половина копейки округляется вверх
+		{1, 49, 0},
+		{1, 50, 1},
+	}
+	for _, tt := range tests {
+		got := percentOf(Money{tt.minor, "RUB"}, tt.pct)
+		if got.Minor != tt.want || got.Currency != "RUB" {
+			t.Errorf("percentOf(%d, %d%%) = %+v, ожидалось %d", tt.minor, tt.pct, got, tt.want)
+		}
+	}
+}
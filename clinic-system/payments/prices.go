@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PriceItem — строка прайс-листа клиники.
+// Пустая Specialty означает цену услуги для любой специальности.
+type PriceItem struct {
+	ID        int    `json:"id"`
+	ClinicID  int    `json:"clinic_id"`
+	Specialty string `json:"specialty"`
+	Service   string `json:"service"`
+	Price     Money  `json:"price"`
+}
+
+const defaultService = "consultation"
+
+func listPrices(db *sql.DB, clinicID int) ([]PriceItem, error) {
+	rows, err := db.Query(`
+		SELECT pl.id, pl.clinic_id, pl.specialty, pl.service, pl.price_minor, cl.currency
+		FROM price_list pl
+		JOIN clinics cl ON cl.id = pl.clinic_id
+		WHERE pl.clinic_id = $1
+		ORDER BY pl.specialty, pl.service`, clinicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []PriceItem{}
+	for rows.Next() {
+		var p PriceItem
+		if err := rows.Scan(&p.ID, &p.ClinicID, &p.Specialty, &p.Service, &p.Price.Minor, &p.Price.Currency); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// clinicCurrency — валюта, в которой клиника задаёт цены и принимает оплату
+func clinicCurrency(db *sql.DB, clinicID int) (string, error) {
+	var currency string
+	err := db.QueryRow(`SELECT currency FROM clinics WHERE id = $1`, clinicID).Scan(&currency)
+	return currency, err
+}
+
+// upsertPrice создаёт строку прайса или меняет цену существующей
+func upsertPrice(db *sql.DB, p *PriceItem) error {
+	return db.QueryRow(`
+		INSERT INTO price_list (clinic_id, specialty, service, price_minor)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (clinic_id, specialty, service) DO UPDATE SET price_minor = EXCLUDED.price_minor
+		RETURNING id`,
+		p.ClinicID, p.Specialty, p.Service, p.Price.Minor).Scan(&p.ID)
+}
+
+// lookupPrice ищет цену услуги: сначала для специальности врача, затем общую по клинике
+func lookupPrice(db *sql.DB, clinicID int, specialty, service string) (Money, error) {
+	var price Money
+	err := db.QueryRow(`
+		SELECT pl.price_minor, cl.currency
+		FROM price_list pl
+		JOIN clinics cl ON cl.id = pl.clinic_id
+		WHERE pl.clinic_id = $1 AND pl.service = $3 AND pl.specialty IN ($2, '')
+		ORDER BY pl.specialty DESC
+		LIMIT 1`, clinicID, specialty, service).Scan(&price.Minor, &price.Currency)
+	return price, err
+}
+
+// appointmentInfo — приём со сведениями о враче и клинике, нужными для оплаты
+type appointmentInfo struct {
+	ID        int
+	PatientID int
+	Status    string
+	StartTime time.Time
+	DoctorID  int
+	Specialty string
+	ClinicID  int
+}
+
+func loadAppointment(db *sql.DB, id int) (*appointmentInfo, error) {
+	a := appointmentInfo{ID: id}
+	err := db.QueryRow(`
+		SELECT a.user_id, a.status, s.start_time, d.id, COALESCE(d.specialty, ''), d.clinic_id
+		FROM appointments a
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		WHERE a.id = $1`, id).
+		Scan(&a.PatientID, &a.Status, &a.StartTime, &a.DoctorID, &a.Specialty, &a.ClinicID)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// loadPaymentAppointment находит платёж из параметра :id и его приём.
+// При ошибке сам отвечает клиенту и возвращает ok == false.
+func loadPaymentAppointment(db *sql.DB, c *gin.Context) (paymentID int, a *appointmentInfo, ok bool) {
+	paymentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "неверный ID платежа"})
+		return 0, nil, false
+	}
+	var appointmentID int
+	err = db.QueryRow(`SELECT appointment_id FROM payments WHERE id = $1`, paymentID).Scan(&appointmentID)
+	if err == nil {
+		a, err = loadAppointment(db, appointmentID)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "платёж не найден"})
+		return 0, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при запросе БД"})
+		return 0, nil, false
+	}
+	return paymentID, a, true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// PaymentProvider — платёжный шлюз. Деньги двигает провайдер, сервис только
+// хранит состояние платежа и узнаёт об изменениях из вебхуков.
+type PaymentProvider interface {
+	Name() string
+	// CreateIntent регистрирует платёж у провайдера и возвращает ссылку на оплату
+	CreateIntent(ctx context.Context, req IntentRequest) (*Intent, error)
+	// Capture списывает ранее авторизованную сумму
+	Capture(ctx context.Context, intentID string) error
+	// Refund возвращает часть или всю сумму, возвращает ID возврата у провайдера
+	Refund(ctx context.Context, intentID string, amount Money) (string, error)
+	// VerifyWebhook проверяет подпись и разбирает уведомление
+	VerifyWebhook(header http.Header, body []byte) (*WebhookEvent, error)
+}
+
+// IntentRequest — что передаём провайдеру при создании платежа
+type IntentRequest struct {
+	PaymentID   int
+	Amount      Money
+	Description string
+}
+
+// Intent — платёж на стороне провайдера
+type Intent struct {
+	ID              string
+	ConfirmationURL string
+}
+
+// Типы событий во вебхуках
+const (
+	eventPaymentAuthorized = "payment.authorized" // деньги заблокированы, нужен Capture
+	eventPaymentSucceeded  = "payment.succeeded"
+	eventPaymentFailed     = "payment.failed"
+)
+
+// WebhookEvent — уведомление провайдера в общем виде
+type WebhookEvent struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	IntentID string `json:"intent_id"`
+}
+
+var errBadSignature = errors.New("неверная подпись вебхука")
+
+// newProviderFromEnv выбирает провайдера по PAYMENT_PROVIDER. Значения по
+// умолчанию нет: тестовый провайдер сам подтверждает оплату, и включать его
+// нужно явно.
+func newProviderFromEnv(db *sql.DB) (PaymentProvider, error) {
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "":
+		return nil, errors.New("не задан PAYMENT_PROVIDER")
+	case "fake":
+		return newFakeProviderFromEnv(db)
+	default:
+		return nil, fmt.Errorf("неизвестный PAYMENT_PROVIDER %q", name)
+	}
+}
+
+// Статусы платежа
+const (
+	paymentPending   = "pending"
+	paymentSucceeded = "succeeded"
+	paymentFailed    = "failed"
+)
+
+// errTransition — платёж уже в состоянии, из которого такой переход невозможен
+var errTransition = errors.New("недопустимый переход статуса платежа")
+
+// transition меняет статус платежа и пишет историю. Повторный переход
+// в тот же статус ничего не делает (changed == false), поэтому вебхуки можно повторять.
+func transition(tx *sql.Tx, paymentID int, to, reason string, from ...string) (changed bool, err error) {
+	var current string
+	err = tx.QueryRow(`SELECT payment_status FROM payments WHERE id = $1 FOR UPDATE`, paymentID).Scan(&current)
+	if err != nil {
+		return false, err
+	}
+	if current == to {
+		return false, nil
+	}
+	allowed := false
+	for _, f := range from {
+		if current == f {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false, fmt.Errorf("%w: %s → %s", errTransition, current, to)
+	}
+
+	if _, err := tx.Exec(`UPDATE payments SET payment_status = $2, updated_at = NOW() WHERE id = $1`, paymentID, to); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO payment_status_history (payment_id, from_status, to_status, reason)
+		VALUES ($1, $2, $3, $4)`, paymentID, current, to, reason)
+	return err == nil, err
+}
+
+// setStatus — transition в отдельной транзакции
+func setStatus(db *sql.DB, paymentID int, to, reason string, from ...string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := transition(tx, paymentID, to, reason, from...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"eventbus"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Receipt — чек по оплате приёма. Реквизиты клиники копируются на момент
+// выдачи, чтобы последующие правки клиники не меняли выданные чеки.
+type Receipt struct {
+	ID            int       `json:"id"`
+	Number        string    `json:"number"`
+	PaymentID     int       `json:"payment_id"`
+	ClinicID      int       `json:"clinic_id"`
+	ClinicName    string    `json:"clinic_name"`
+	ClinicAddress string    `json:"clinic_address"`
+	ClinicPhone   string    `json:"clinic_phone"`
+	PayerName     string    `json:"payer_name"`
+	Service       string    `json:"service"`
+	Description   string    `json:"description"`
+	Amount        Money     `json:"amount"`
+	TaxRate       string    `json:"tax_rate"` // проценты, например "20.00"
+	TaxAmount     Money     `json:"tax_amount"`
+	IssuedAt      time.Time `json:"issued_at"`
+}
+
+// errNotPaid — чек выдаётся только по проведённой оплате
+var errNotPaid = errors.New("платёж ещё не проведён")
+
+// queryRower — *sql.DB или *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func loadReceipt(q queryRower, paymentID int) (*Receipt, error) {
+	var rc Receipt
+	err := q.QueryRow(`
+		SELECT id, number, payment_id, clinic_id, clinic_name, clinic_address, clinic_phone,
+		       COALESCE(payer_name, ''), service, COALESCE(description, ''),
+		       amount_minor, tax_rate, tax_amount_minor, currency, issued_at
+		FROM receipts WHERE payment_id = $1`, paymentID).
+		Scan(&rc.ID, &rc.Number, &rc.PaymentID, &rc.ClinicID, &rc.ClinicName, &rc.ClinicAddress, &rc.ClinicPhone,
+			&rc.PayerName, &rc.Service, &rc.Description,
+			&rc.Amount.Minor, &rc.TaxRate, &rc.TaxAmount.Minor, &rc.Amount.Currency, &rc.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	rc.TaxAmount.Currency = rc.Amount.Currency
+	return &rc, nil
+}
+
+// issueReceipt выдаёт чек по платежу или возвращает уже выданный.
+// Номер вида "<клиника>-<год>-<порядковый>" выделяется под блокировкой
+// платежа, поэтому в нумерации не бывает дублей и пропусков.
+func issueReceipt(ctx context.Context, db *sql.DB, paymentID int) (*Receipt, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow(`SELECT payment_status FROM payments WHERE id = $1 FOR UPDATE`, paymentID).Scan(&status); err != nil {
+		return nil, err
+	}
+	if rc, err := loadReceipt(tx, paymentID); err == nil {
+		return rc, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if status != paymentSucceeded && status != paymentPartiallyRefunded && status != paymentRefunded {
+		return nil, errNotPaid
+	}
+
+	rc := Receipt{PaymentID: paymentID}
+	var patientID int
+	var doctor, specialty string
+	var start time.Time
+	// Налог включён в цену: выделяем его из суммы. Считаем в NUMERIC,
+	// чтобы округление до минорной единицы было точным.
+	err = tx.QueryRow(`
+		SELECT p.amount_minor, p.currency, p.service, cl.id, cl.name, cl.address, cl.phone, cl.tax_rate,
+		       ROUND(p.amount_minor * cl.tax_rate / (100 + cl.tax_rate))::BIGINT,
+		       COALESCE(u.full_name, ''), COALESCE(d.full_name, ''), COALESCE(d.specialty, ''), s.start_time, a.user_id
+		FROM payments p
+		JOIN appointments a ON a.id = p.appointment_id
+		JOIN users u ON u.id = a.user_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE p.id = $1`, paymentID).
+		Scan(&rc.Amount.Minor, &rc.Amount.Currency, &rc.Service, &rc.ClinicID, &rc.ClinicName, &rc.ClinicAddress, &rc.ClinicPhone,
+			&rc.TaxRate, &rc.TaxAmount.Minor, &rc.PayerName, &doctor, &specialty, &start, &patientID)
+	if err != nil {
+		return nil, err
+	}
+	rc.TaxAmount.Currency = rc.Amount.Currency
+	rc.Description = fmt.Sprintf("Приём: %s (%s), %s", doctor, specialty, start.Format("02.01.2006 15:04"))
+
+	year := time.Now().Year()
+	var seq int
+	err = tx.QueryRow(`
+		INSERT INTO receipt_counters (clinic_id, year, last_number) VALUES ($1, $2, 1)
+		ON CONFLICT (clinic_id, year) DO UPDATE SET last_number = receipt_counters.last_number + 1
+		RETURNING last_number`, rc.ClinicID, year).Scan(&seq)
+	if err != nil {
+		return nil, err
+	}
+	rc.Number = fmt.Sprintf("%d-%d-%06d", rc.ClinicID, year, seq)
+
+	err = tx.QueryRow(`
+		INSERT INTO receipts (number, payment_id, clinic_id, clinic_name, clinic_address, clinic_phone,
+		                      payer_name, service, description, amount_minor, tax_rate, tax_amount_minor, currency)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id, issued_at`,
+		rc.Number, rc.PaymentID, rc.ClinicID, rc.ClinicName, rc.ClinicAddress, rc.ClinicPhone,
+		rc.PayerName, rc.Service, rc.Description, rc.Amount.Minor, rc.TaxRate, rc.TaxAmount.Minor, rc.Amount.Currency).
+		Scan(&rc.ID, &rc.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = eventbus.Publish(ctx, tx, eventbus.ReceiptIssued, eventbus.Receipt{
+		ReceiptID:   rc.ID,
+		Number:      rc.Number,
+		PaymentID:   rc.PaymentID,
+		PatientID:   patientID,
+		ClinicID:    rc.ClinicID,
+		AmountMinor: rc.Amount.Minor,
+		Amount:      rc.Amount.String(),
+		Currency:    rc.Amount.Currency,
+		IssuedAt:    rc.IssuedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// pdfFontPath — TTF с кириллицей; в образе ставится пакет fonts-dejavu-core
+func pdfFontPath() string {
+	if p := os.Getenv("PDF_FONT_PATH"); p != "" {
+		return p
+	}
+	return "/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf"
+}
+
+// writeReceiptPDF печатает чек в PDF
+func writeReceiptPDF(w io.Writer, rc *Receipt) error {
+	font, err := os.ReadFile(pdfFontPath())
+	if err != nil {
+		return fmt.Errorf("шрифт для PDF: %w", err)
+	}
+
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.AddUTF8FontFromBytes("main", "", font)
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	pdf.SetFont("main", "", 16)
+	pdf.CellFormat(0, 10, "Чек № "+rc.Number, "", 1, "L", false, 0, "")
+	pdf.SetFont("main", "", 10)
+	pdf.CellFormat(0, 6, "от "+rc.IssuedAt.Format("02.01.2006 15:04"), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	pdf.CellFormat(0, 6, rc.ClinicName, "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, rc.ClinicAddress, "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, "Тел.: "+rc.ClinicPhone, "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	if rc.PayerName != "" {
+		pdf.CellFormat(0, 6, "Плательщик: "+rc.PayerName, "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(2)
+
+	pdf.CellFormat(120, 8, "Услуга", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(50, 8, "Сумма", "1", 1, "R", false, 0, "")
+	pdf.CellFormat(120, 8, rc.Service, "LR", 0, "L", false, 0, "")
+	pdf.CellFormat(50, 8, rc.Amount.String()+" "+rc.Amount.Currency, "LR", 1, "R", false, 0, "")
+	pdf.MultiCell(170, 6, rc.Description, "LRB", "L", false)
+	pdf.Ln(2)
+
+	pdf.CellFormat(120, 7, "Итого:", "", 0, "R", false, 0, "")
+	pdf.CellFormat(50, 7, rc.Amount.String()+" "+rc.Amount.Currency, "", 1, "R", false, 0, "")
+	tax := "Без НДС"
+	if rc.TaxAmount.Minor > 0 {
+		tax = fmt.Sprintf("в т.ч. НДС %s%%: %s %s", strings.TrimSuffix(rc.TaxRate, ".00"), rc.TaxAmount, rc.TaxAmount.Currency)
+	}
+	pdf.CellFormat(170, 7, tax, "", 1, "R", false, 0, "")
+
+	return pdf.Output(w)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"eventbus"
+)
+
+// Статусы платежа после возвратов
+const (
+	paymentPartiallyRefunded = "partially_refunded"
+	paymentRefunded          = "refunded"
+)
+
+// Статусы возврата: pending — записан, но провайдер ещё не ответил
+const (
+	refundPending   = "pending"
+	refundSucceeded = "succeeded"
+	refundFailed    = "failed"
+)
+
+// Refund — возврат по платежу. InitiatedBy пуст у автоматических возвратов.
+type Refund struct {
+	ID               int       `json:"id"`
+	PaymentID        int       `json:"payment_id"`
+	Amount           Money     `json:"amount"`
+	Reason           string    `json:"reason"`
+	InitiatedBy      *int      `json:"initiated_by"`
+	ProviderRefundID string    `json:"provider_refund_id"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// StatusChange — запись истории статусов платежа
+type StatusChange struct {
+	FromStatus *string   `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var (
+	errNotRefundable = errors.New("платёж нельзя вернуть в текущем статусе")
+	errRefundAmount  = errors.New("сумма возврата должна быть больше нуля и не больше остатка")
+	errRefundFailed  = errors.New("провайдер отклонил возврат")
+)
+
+// refundPolicy — правила возврата при отмене приёма пациентом.
+// Своевременная отмена — полный возврат, поздняя — LatePercent процентов.
+// Позднюю отмену отмечает сервис записи по сроку клиники (cancelled_late);
+// FreeBefore нужен, только если неизвестно, кто отменил запись.
+// Отмена клиникой — всегда полный возврат.
+type refundPolicy struct {
+	FreeBefore  time.Duration
+	LatePercent int
+}
+
+func refundPolicyFromEnv() refundPolicy {
+	p := refundPolicy{FreeBefore: 24 * time.Hour}
+	if h, err := strconv.Atoi(os.Getenv("REFUND_FREE_HOURS")); err == nil && h >= 0 {
+		p.FreeBefore = time.Duration(h) * time.Hour
+	}
+	if pct, err := strconv.Atoi(os.Getenv("REFUND_LATE_PERCENT")); err == nil && pct >= 0 && pct <= 100 {
+		p.LatePercent = pct
+	}
+	return p
+}
+
+// amountFor — сколько вернуть пациенту за отмену; late — отмена поздняя
+func (p refundPolicy) amountFor(paid Money, late bool) Money {
+	if !late {
+		return paid
+	}
+	return percentOf(paid, int64(p.LatePercent))
+}
+
+// isLate — поздняя ли отмена пациентом. Если отменивший неизвестен, флаг
+// cancelled_late никто не вычислял, и срок считается по FreeBefore.
+func (p refundPolicy) isLate(cp cancelledPayment) bool {
+	if cp.CancelledByKnown {
+		return cp.CancelledLate
+	}
+	return cp.Start.Sub(cp.CancelledAt) < p.FreeBefore
+}
+
+// refundPayment возвращает amount минорных единиц в валюте платежа (0 — весь остаток)
+// через провайдера и обновляет статус. Возврат сначала записывается как
+// pending и фиксируется, затем идёт вызов провайдера, затем отдельная
+// транзакция завершает его: деньги не уходят без записи в БД, а строка
+// платежа не заблокирована на время сетевого вызова.
+func refundPayment(ctx context.Context, db *sql.DB, provider PaymentProvider, paymentID int, amount int64, reason string, initiatedBy *int) (*Refund, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rf, intentID, err := reserveRefund(ctx, tx, paymentID, amount, reason, initiatedBy)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return completeRefund(ctx, db, provider, rf, intentID)
+}
+
+// reserveRefund записывает возврат в статусе pending в транзакции
+// вызывающего. Строка платежа блокируется до конца транзакции, а pending
+// возвраты входят в уже возвращённую сумму, чтобы два возврата не
+// превысили остаток.
+func reserveRefund(ctx context.Context, tx *sql.Tx, paymentID int, amount int64, reason string, initiatedBy *int) (rf *Refund, intentID string, err error) {
+	var status string
+	var paid Money
+	var refunded int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT p.payment_status, COALESCE(p.provider_intent_id, ''), p.amount_minor, p.currency,
+		       COALESCE((SELECT SUM(amount_minor) FROM payment_refunds WHERE payment_id = p.id AND status <> $2), 0)
+		FROM payments p WHERE p.id = $1
+		FOR UPDATE OF p`, paymentID, refundFailed).Scan(&status, &intentID, &paid.Minor, &paid.Currency, &refunded)
+	if err != nil {
+		return nil, "", err
+	}
+	if status != paymentSucceeded && status != paymentPartiallyRefunded {
+		return nil, "", errNotRefundable
+	}
+	remaining := paid.Minor - refunded
+	if amount == 0 {
+		amount = remaining // полный возврат остатка
+	}
+	if amount <= 0 || amount > remaining {
+		return nil, "", errRefundAmount
+	}
+
+	rf = &Refund{PaymentID: paymentID, Amount: Money{Minor: amount, Currency: paid.Currency}, Reason: reason, InitiatedBy: initiatedBy, Status: refundPending}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO payment_refunds (payment_id, amount_minor, reason, initiated_by, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`,
+		rf.PaymentID, rf.Amount.Minor, rf.Reason, rf.InitiatedBy, rf.Status).Scan(&rf.ID, &rf.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	return rf, intentID, nil
+}
+
+// completeRefund проводит записанный возврат у провайдера и завершает его.
+// Отказ провайдера отмечает возврат failed и возвращает errRefundFailed.
+func completeRefund(ctx context.Context, db *sql.DB, provider PaymentProvider, rf *Refund, intentID string) (*Refund, error) {
+	// Запрос клиента может оборваться, но результат вызова провайдера
+	// нужно сохранить в любом случае
+	save := context.WithoutCancel(ctx)
+
+	// Платежи, проведённые до подключения провайдера, возвращаются вручную
+	if intentID != "" {
+		providerRefundID, err := provider.Refund(ctx, intentID, rf.Amount)
+		if err != nil {
+			if _, ferr := db.ExecContext(save, `UPDATE payment_refunds SET status = $2 WHERE id = $1`, rf.ID, refundFailed); ferr != nil {
+				log.Printf("возврат %d по платежу %d: не удалось отметить отказ провайдера: %v", rf.ID, rf.PaymentID, ferr)
+			}
+			return nil, fmt.Errorf("%w: %w", errRefundFailed, err)
+		}
+		rf.ProviderRefundID = providerRefundID
+	}
+
+	tx, err := db.BeginTx(save, nil)
+	if err != nil {
+		return nil, pendingRefund(rf, err)
+	}
+	defer tx.Rollback()
+
+	var paid, refunded int64
+	err = tx.QueryRowContext(save, `
+		SELECT p.amount_minor,
+		       COALESCE((SELECT SUM(amount_minor) FROM payment_refunds
+		                 WHERE payment_id = p.id AND (status = $2 OR id = $3)), 0)
+		FROM payments p WHERE p.id = $1
+		FOR UPDATE OF p`, rf.PaymentID, refundSucceeded, rf.ID).Scan(&paid, &refunded)
+	if err != nil {
+		return nil, pendingRefund(rf, err)
+	}
+	if _, err := tx.ExecContext(save, `
+		UPDATE payment_refunds SET status = $2, provider_refund_id = NULLIF($3, '')
+		WHERE id = $1`, rf.ID, refundSucceeded, rf.ProviderRefundID); err != nil {
+		return nil, pendingRefund(rf, err)
+	}
+	to := paymentPartiallyRefunded
+	if refunded >= paid {
+		to = paymentRefunded
+	}
+	if _, err := transition(tx, rf.PaymentID, to, rf.Reason, paymentSucceeded, paymentPartiallyRefunded); err != nil {
+		return nil, pendingRefund(rf, err)
+	}
+	if err := publishPayment(save, tx, eventbus.PaymentRefunded, rf.PaymentID, rf.Amount.Minor); err != nil {
+		return nil, pendingRefund(rf, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, pendingRefund(rf, err)
+	}
+	rf.Status = refundSucceeded
+	return rf, nil
+}
+
+// pendingRefund — провайдер вернул деньги, но завершить возврат в БД не
+// удалось: он остаётся pending, и его нужно разбирать вручную
+func pendingRefund(rf *Refund, err error) error {
+	log.Printf("ВНИМАНИЕ: возврат %d по платежу %d прошёл у провайдера (%s), но остался в статусе pending: %v",
+		rf.ID, rf.PaymentID, rf.ProviderRefundID, err)
+	return err
+}
+
+func listRefunds(db *sql.DB, paymentID int) ([]Refund, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.payment_id, r.amount_minor, p.currency, COALESCE(r.reason, ''), r.initiated_by,
+		       COALESCE(r.provider_refund_id, ''), r.status, r.created_at
+		FROM payment_refunds r
+		JOIN payments p ON p.id = r.payment_id
+		WHERE r.payment_id = $1 ORDER BY r.id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Refund{}
+	for rows.Next() {
+		var rf Refund
+		if err := rows.Scan(&rf.ID, &rf.PaymentID, &rf.Amount.Minor, &rf.Amount.Currency, &rf.Reason, &rf.InitiatedBy, &rf.ProviderRefundID, &rf.Status, &rf.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, rf)
+	}
+	return list, rows.Err()
+}
+
+func listStatusHistory(db *sql.DB, paymentID int) ([]StatusChange, error) {
+	rows, err := db.Query(`
+		SELECT from_status, to_status, COALESCE(reason, ''), created_at
+		FROM payment_status_history WHERE payment_id = $1 ORDER BY id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []StatusChange{}
+	for rows.Next() {
+		var sc StatusChange
+		if err := rows.Scan(&sc.FromStatus, &sc.ToStatus, &sc.Reason, &sc.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, sc)
+	}
+	return list, rows.Err()
+}
+
+// cancelledPayment — оплаченный приём, который отменили, а возврат ещё не делали
+type cancelledPayment struct {
+	PaymentID     int
+	Paid          Money
+	CancelledAt   time.Time
+	Start         time.Time
+	AppointmentID int
+	// ByClinic — отменил не сам пациент; отмена без автора считается
+	// отменой пациентом
+	ByClinic         bool
+	CancelledByKnown bool
+	CancelledLate    bool
+}
+
+// processCancellations делает автоматические возвраты по отменённым приёмам:
+// отмена клиникой — полный возврат, отмена пациентом — по refundPolicy.
+func processCancellations(ctx context.Context, db *sql.DB, provider PaymentProvider, policy refundPolicy) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.id, p.amount_minor, p.currency, a.cancelled_at, s.start_time, a.id,
+		       COALESCE(a.cancelled_by <> a.user_id, false), a.cancelled_by IS NOT NULL, a.cancelled_late
+		FROM payments p
+		JOIN appointments a ON a.id = p.appointment_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		WHERE a.status = $1
+		  AND a.cancelled_at IS NOT NULL
+		  AND p.payment_status = $2
+		  AND p.cancellation_handled_at IS NULL
+		ORDER BY a.cancelled_at
+		LIMIT 100`, appointmentCancelled, paymentSucceeded)
+	if err != nil {
+		return err
+	}
+	var list []cancelledPayment
+	for rows.Next() {
+		var cp cancelledPayment
+		if err := rows.Scan(&cp.PaymentID, &cp.Paid.Minor, &cp.Paid.Currency, &cp.CancelledAt, &cp.Start, &cp.AppointmentID,
+			&cp.ByClinic, &cp.CancelledByKnown, &cp.CancelledLate); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, cp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, cp := range list {
+		if err := refundCancelled(ctx, db, provider, policy, cp); err != nil {
+			// Оставляем необработанным — повторим на следующем проходе
+			log.Printf("автовозврат по приёму %d: %v", cp.AppointmentID, err)
+		}
+	}
+	return nil
+}
+
+// refundCancelled делает возврат по одному отменённому приёму. Платёж
+// помечается обработанным в той же транзакции, где записывается возврат:
+// обработчик события и воркер на каждой реплике могут взять один платёж
+// одновременно, и возврат должен пройти только у того, кто пометил его
+// первым. Если провайдер отказал, отметка снимается и возврат повторится
+// на следующем проходе.
+func refundCancelled(ctx context.Context, db *sql.DB, provider PaymentProvider, policy refundPolicy, cp cancelledPayment) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE payments SET cancellation_handled_at = NOW()
+		WHERE id = $1 AND cancellation_handled_at IS NULL`, cp.PaymentID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err // уже обработан другим проходом
+	}
+
+	amount, reason := cp.Paid, "автоматический возврат: приём отменён клиникой"
+	if !cp.ByClinic {
+		amount = policy.amountFor(cp.Paid, policy.isLate(cp))
+		reason = "автоматический возврат: приём отменён пациентом"
+	}
+	if amount.Minor == 0 {
+		return tx.Commit()
+	}
+	rf, intentID, err := reserveRefund(ctx, tx, cp.PaymentID, amount.Minor, reason, nil)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	_, err = completeRefund(ctx, db, provider, rf, intentID)
+	if errors.Is(err, errRefundFailed) {
+		if _, uerr := db.ExecContext(context.WithoutCancel(ctx), `
+			UPDATE payments SET cancellation_handled_at = NULL WHERE id = $1`, cp.PaymentID); uerr != nil {
+			log.Printf("автовозврат по приёму %d: не удалось снять отметку обработки: %v", cp.AppointmentID, uerr)
+		}
+	}
+	return err
+}
+
+// runRefundWorker периодически обрабатывает отменённые оплаченные приёмы
+func runRefundWorker(db *sql.DB, provider PaymentProvider, policy refundPolicy, every time.Duration) {
+	for {
+		if err := processCancellations(context.Background(), db, provider, policy); err != nil {
+			log.Printf("автовозвраты: %v", err)
+		}
+		time.Sleep(every)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefundPolicyAmountFor(t *testing.T) {
+	paid := Money{Minor: 150000, Currency: "RUB"}
+	tests := []struct {
+		name   string
+		policy refundPolicy
+		late   bool
+		want   int64
+	}{
+		{"вовремя — полный возврат", refundPolicy{LatePercent: 0}, false, 150000},
+		{"поздно, без возврата", refundPolicy{LatePercent: 0}, true, 0},
+		{"поздно, половина", refundPolicy{LatePercent: 50}, true, 75000},
+		{"поздно, весь", refundPolicy{LatePercent: 100}, true, 150000},
+		{"поздно, с округлением", refundPolicy{LatePercent: 33}, true, 49500},
+	}
+	for _, tt := range tests {
+		got := tt.policy.amountFor(paid, tt.late)
+		if got.Minor != tt.want || got.Currency != paid.Currency {
+			t.Errorf("%s: amountFor = %+v, ожидалось %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRefundPolicyIsLate(t *testing.T) {
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	policy := refundPolicy{FreeBefore: 24 * time.Hour}
+	tests := []struct {
+		name string
+		cp   cancelledPayment
+		want bool
+	}{
+		{"автор известен, сервис записи отметил позднюю",
+			cancelledPayment{CancelledByKnown: true, CancelledLate: true, CancelledAt: start.Add(-72 * time.Hour), Start: start}, true},
+		{"автор известен, отмена вовремя по правилам клиники",
+			cancelledPayment{CancelledByKnown: true, CancelledLate: false, CancelledAt: start.Add(-time.Hour), Start: start}, false},
+		{"автор неизвестен, раньше FreeBefore",
+			cancelledPayment{CancelledAt: start.Add(-25 * time.Hour), Start: start}, false},
+		{"автор неизвестен, ровно FreeBefore",
+			cancelledPayment{CancelledAt: start.Add(-24 * time.Hour), Start: start}, false},
+		{"автор неизвестен, позже FreeBefore",
+			cancelledPayment{CancelledAt: start.Add(-23 * time.Hour), Start: start}, true},
+	}
+	for _, tt := range tests {
+		if got := policy.isLate(tt.cp); got != tt.want {
+			t.Errorf("%s: isLate = %v, ожидалось %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// paidStatuses — платежи, по которым клиника получила деньги (возвраты учитываются отдельно)
+var paidStatuses = []string{paymentSucceeded, paymentPartiallyRefunded, paymentRefunded}
+
+// reportFilter — параметры отчётов
+type reportFilter struct {
+	ClinicID *int
+	From     *time.Time // включительно
+	To       *time.Time // не включительно
+	GroupBy  string     // clinic, doctor, specialty
+	Period   string     // day, week, month
+}
+
+var errForbiddenReport = errors.New("отчёты доступны только администраторам")
+
+// parseReportFilter разбирает query-параметры. Администратор клиники видит
+// только свою клинику, администратор системы — все или одну по clinic_id.
+func parseReportFilter(c *gin.Context, u *caller) (*reportFilter, error) {
+	f := reportFilter{
+		GroupBy: c.DefaultQuery("group_by", "clinic"),
+		Period:  c.DefaultQuery("period", "month"),
+	}
+
+	switch u.Role {
+	case roleClinicAdmin:
+		if u.ClinicID == nil {
+			return nil, errForbiddenReport
+		}
+		f.ClinicID = u.ClinicID
+	case roleAdmin:
+		if s := c.Query("clinic_id"); s != "" {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("неверный clinic_id")
+			}
+			f.ClinicID = &id
+		}
+	default:
+		return nil, errForbiddenReport
+	}
+
+	if _, ok := reportGroups[f.GroupBy]; !ok {
+		return nil, fmt.Errorf("group_by должен быть clinic, doctor или specialty")
+	}
+	if f.Period != "day" && f.Period != "week" && f.Period != "month" {
+		return nil, fmt.Errorf("period должен быть day, week или month")
+	}
+	var err error
+	if f.From, f.To, err = parseDateRange(c); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// reportGroups — выражения для ключа группировки: ID и название
+var reportGroups = map[string][2]string{
+	"clinic":    {"cl.id", "cl.name"},
+	"doctor":    {"d.id", "COALESCE(d.full_name, '')"},
+	"specialty": {"0", "COALESCE(d.specialty, '')"},
+}
+
+// RevenueRow — выручка одной группы за один период.
+// Возвраты относятся к периоду, в котором они сделаны, а не к периоду оплаты.
+type RevenueRow struct {
+	Period   time.Time `json:"period"`
+	KeyID    int       `json:"key_id,omitempty"`
+	KeyName  string    `json:"key_name"`
+	Payments int       `json:"payments"`
+	Gross    Money     `json:"gross"`
+	Refunded Money     `json:"refunded"`
+	Net      Money     `json:"net"`
+}
+
+// RevenueTotal — итог по валюте: клиники могут работать в разных валютах
+type RevenueTotal struct {
+	Currency string `json:"currency"`
+	Payments int    `json:"payments"`
+	Gross    Money  `json:"gross"`
+	Refunded Money  `json:"refunded"`
+	Net      Money  `json:"net"`
+}
+
+func queryRevenue(db *sql.DB, f *reportFilter) ([]RevenueRow, error) {
+	args := []any{pq.Array(paidStatuses)}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := []string{"TRUE"}
+	if f.ClinicID != nil {
+		where = append(where, "cl.id = "+arg(*f.ClinicID))
+	}
+	if f.From != nil {
+		where = append(where, "e.at >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "e.at < "+arg(*f.To))
+	}
+	key := reportGroups[f.GroupBy]
+
+	// Period и GroupBy проверены в parseReportFilter, поэтому их можно подставлять в текст
+	rows, err := db.Query(`
+		WITH entries AS (
+			SELECT p.payment_date AS at, p.appointment_id, p.currency,
+			       p.amount_minor AS gross, 0::BIGINT AS refunded, 1 AS paid
+			FROM payments p
+			WHERE p.payment_status = ANY($1)
+			UNION ALL
+			SELECT r.created_at, p.appointment_id, p.currency, 0, r.amount_minor, 0
+			FROM payment_refunds r
+			JOIN payments p ON p.id = r.payment_id
+			WHERE r.status = 'succeeded'
+		)
+		SELECT date_trunc('`+f.Period+`', e.at), `+key[0]+`, `+key[1]+`, e.currency,
+		       SUM(e.paid), SUM(e.gross), SUM(e.refunded)
+		FROM entries e
+		JOIN appointments a ON a.id = e.appointment_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		JOIN clinics cl ON cl.id = d.clinic_id
+		WHERE `+strings.Join(where, " AND ")+`
+		GROUP BY 1, 2, 3, 4
+		ORDER BY 1, 3, 4`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []RevenueRow{}
+	for rows.Next() {
+		var r RevenueRow
+		var currency string
+		if err := rows.Scan(&r.Period, &r.KeyID, &r.KeyName, &currency,
+			&r.Payments, &r.Gross.Minor, &r.Refunded.Minor); err != nil {
+			return nil, err
+		}
+		r.Gross.Currency, r.Refunded.Currency = currency, currency
+		r.Net = Money{Minor: r.Gross.Minor - r.Refunded.Minor, Currency: currency}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+func revenueTotals(rows []RevenueRow) []RevenueTotal {
+	totals := []RevenueTotal{}
+	idx := map[string]int{}
+	for _, r := range rows {
+		cur := r.Gross.Currency
+		i, ok := idx[cur]
+		if !ok {
+			i = len(totals)
+			idx[cur] = i
+			totals = append(totals, RevenueTotal{
+				Currency: cur,
+				Gross:    Money{Currency: cur},
+				Refunded: Money{Currency: cur},
+				Net:      Money{Currency: cur},
+			})
+		}
+		t := &totals[i]
+		t.Payments += r.Payments
+		t.Gross.Minor += r.Gross.Minor
+		t.Refunded.Minor += r.Refunded.Minor
+		t.Net.Minor += r.Net.Minor
+	}
+	return totals
+}
+
+func writeRevenueCSV(w io.Writer, rows []RevenueRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"period", "key_id", "key_name", "currency", "payments", "gross", "refunded", "net"})
+	for _, r := range rows {
+		cw.Write([]string{
+			r.Period.Format("2006-01-02"),
+			strconv.Itoa(r.KeyID),
+			r.KeyName,
+			r.Gross.Currency,
+			strconv.Itoa(r.Payments),
+			r.Gross.String(),
+			r.Refunded.String(),
+			r.Net.String(),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// OutstandingItem — завершённый приём без проведённой оплаты
+type OutstandingItem struct {
+	AppointmentID int       `json:"appointment_id"`
+	StartTime     time.Time `json:"start_time"`
+	PatientID     int       `json:"patient_id"`
+	PatientName   string    `json:"patient_name"`
+	DoctorID      int       `json:"doctor_id"`
+	DoctorName    string    `json:"doctor_name"`
+	Specialty     string    `json:"specialty"`
+	ClinicID      int       `json:"clinic_id"`
+	// Цена консультации по прайсу; nil, если цена не задана
+	AmountDue *Money `json:"amount_due"`
+}
+
+// queryOutstanding — завершённые приёмы, по которым нет проведённой оплаты.
+// Период фильтрует по времени приёма.
+func queryOutstanding(db *sql.DB, f *reportFilter) ([]OutstandingItem, error) {
+	args := []any{pq.Array(paidStatuses), appointmentCompleted, defaultService}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := []string{"a.status = $2"}
+	if f.ClinicID != nil {
+		where = append(where, "cl.id = "+arg(*f.ClinicID))
+	}
+	if f.From != nil {
+		where = append(where, "s.start_time >= "+arg(*f.From))
+	}
+	if f.To != nil {
+		where = append(where, "s.start_time < "+arg(*f.To))
+	}
+
+	rows, err := db.Query(`
+		SELECT a.id, s.start_time, a.user_id, COALESCE(u.full_name, ''),
+		       d.id, COALESCE(d.full_name, ''), COALESCE(d.specialty, ''), cl.id, cl.currency,
+		       price.price_minor
+		FROM appointments a
+		JOIN users u ON u.id = a.user_id
+		JOIN schedule_slots s ON s.id = a.slot_id
+		JOIN doctors d ON d.id = s.doctor_id
+		JOIN clinics cl ON cl.id = d.clinic_id
+		LEFT JOIN LATERAL (
+			SELECT pl.price_minor FROM price_list pl
+			WHERE pl.clinic_id = cl.id AND pl.service = $3
+			  AND pl.specialty IN (COALESCE(d.specialty, ''), '')
+			ORDER BY pl.specialty DESC
+			LIMIT 1
+		) price ON TRUE
+		WHERE `+strings.Join(where, " AND ")+`
+		  AND NOT EXISTS (
+			SELECT 1 FROM payments p
+			WHERE p.appointment_id = a.id AND p.payment_status = ANY($1)
+		  )
+		ORDER BY s.start_time, a.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []OutstandingItem{}
+	for rows.Next() {
+		var it OutstandingItem
+		var currency string
+		var due sql.NullInt64
+		if err := rows.Scan(&it.AppointmentID, &it.StartTime, &it.PatientID, &it.PatientName,
+			&it.DoctorID, &it.DoctorName, &it.Specialty, &it.ClinicID, &currency, &due); err != nil {
+			return nil, err
+		}
+		if due.Valid {
+			it.AmountDue = &Money{Minor: due.Int64, Currency: currency}
+		}
+		list = append(list, it)
+	}
+	return list, rows.Err()
+}
+
+// outstandingTotals — сумма к оплате по валютам (без приёмов, для которых нет цены)
+func outstandingTotals(items []OutstandingItem) []Money {
+	totals := []Money{}
+	idx := map[string]int{}
+	for _, it := range items {
+		if it.AmountDue == nil {
+			continue
+		}
+		i, ok := idx[it.AmountDue.Currency]
+		if !ok {
+			i = len(totals)
+			idx[it.AmountDue.Currency] = i
+			totals = append(totals, Money{Currency: it.AmountDue.Currency})
+		}
+		totals[i].Minor += it.AmountDue.Minor
+	}
+	return totals
+}
+
+func writeOutstandingCSV(w io.Writer, items []OutstandingItem) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"appointment_id", "start_time", "patient_id", "patient_name",
+		"doctor_id", "doctor_name", "specialty", "clinic_id", "currency", "amount_due"})
+	for _, it := range items {
+		currency, due := "", ""
+		if it.AmountDue != nil {
+			currency, due = it.AmountDue.Currency, it.AmountDue.String()
+		}
+		cw.Write([]string{
+			strconv.Itoa(it.AppointmentID),
+			it.StartTime.Format("2006-01-02 15:04"),
+			strconv.Itoa(it.PatientID),
+			it.PatientName,
+			strconv.Itoa(it.DoctorID),
+			it.DoctorName,
+			it.Specialty,
+			strconv.Itoa(it.ClinicID),
+			currency,
+			due,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
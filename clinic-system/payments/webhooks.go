@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"eventbus"
+)
+
+// errUnknownIntent — вебхук пришёл по платежу, которого у нас нет
+var errUnknownIntent = errors.New("платёж провайдера не найден")
+
+// applyWebhook переводит платёж по событию провайдера. Событие с тем же ID
+// обрабатывается один раз: повторная доставка возвращает duplicate == true.
+func applyWebhook(ctx context.Context, db *sql.DB, provider PaymentProvider, ev *WebhookEvent) (duplicate bool, err error) {
+	if ev.Type == eventPaymentAuthorized {
+		if err := captureAuthorized(ctx, db, provider, ev); err != nil {
+			return false, err
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO processed_webhook_events (provider, event_id, event_type)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, provider.Name(), ev.ID, ev.Type)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return true, nil
+	}
+
+	var paymentID int
+	err = tx.QueryRow(`SELECT id FROM payments WHERE provider = $1 AND provider_intent_id = $2`,
+		provider.Name(), ev.IntentID).Scan(&paymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errUnknownIntent
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var changed bool
+	switch ev.Type {
+	case eventPaymentAuthorized:
+		changed, err = transition(tx, paymentID, paymentSucceeded, "списано после авторизации", paymentPending)
+	case eventPaymentSucceeded:
+		changed, err = transition(tx, paymentID, paymentSucceeded, "провайдер подтвердил оплату", paymentPending)
+	case eventPaymentFailed:
+		_, err = transition(tx, paymentID, paymentFailed, "провайдер отклонил оплату", paymentPending)
+	default:
+		// Неинтересные нам события только отмечаем как обработанные
+	}
+	if err != nil {
+		return false, err
+	}
+	// Провайдер может прислать и authorized, и succeeded по одному платежу —
+	// событие публикуем только при самом переходе в succeeded
+	if changed && ev.Type != eventPaymentFailed {
+		// Чек выдаёт подписчик payment.succeeded: подтверждение оплаты
+		// не ждёт его и не откатывается, если выдать чек не вышло
+		if err := publishPayment(ctx, tx, eventbus.PaymentSucceeded, paymentID, 0); err != nil {
+			return false, err
+		}
+	}
+	return false, tx.Commit()
+}
+
+// captureAuthorized списывает авторизованный платёж: оплата приёма не требует
+// ручного подтверждения. Запрос к провайдеру идёт до транзакции вебхука, чтобы
+// не держать блокировку строки платежа. Capture идемпотентен, поэтому если
+// транзакция потом не пройдёт, повторная доставка вебхука просто спишет снова.
+func captureAuthorized(ctx context.Context, db *sql.DB, provider PaymentProvider, ev *WebhookEvent) error {
+	var status string
+	var processed bool
+	err := db.QueryRowContext(ctx, `
+		SELECT payment_status,
+		       EXISTS (SELECT 1 FROM processed_webhook_events WHERE provider = $1 AND event_id = $3)
+		FROM payments WHERE provider = $1 AND provider_intent_id = $2`,
+		provider.Name(), ev.IntentID, ev.ID).Scan(&status, &processed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errUnknownIntent
+	}
+	if err != nil {
+		return err
+	}
+	// Повтор или платёж уже не ждёт оплаты — разберётся транзакция вебхука
+	if processed || status != paymentPending {
+		return nil
+	}
+	if err := provider.Capture(ctx, ev.IntentID); err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"time"
 
+	"eventbus"
+
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/lib/pq"
@@ -23,8 +25,8 @@ type User struct {
 	ClinicID *int   `json:"clinic_id"`
 }
 
-// Секрет для подписи (лучше хранить в ENV)
-var jwtSecret = []byte("supersecret")
+// jwtSecret — ключ подписи токенов из JWT_SECRET; gateway проверяет токены тем же ключом
+var jwtSecret []byte
 
 func main() {
 	// Читаем из ENV
@@ -32,6 +34,9 @@ func main() {
 	if dbURL == "" {
 		log.Fatal("DATABASE_URL не задан")
 	}
+	if jwtSecret = []byte(os.Getenv("JWT_SECRET")); len(jwtSecret) == 0 {
+		log.Fatal("JWT_SECRET не задан")
+	}
 
 	// Подключаемся к PostgreSQL
 	db, err := sql.Open("postgres", dbURL)
@@ -69,8 +74,15 @@ func main() {
 			return
 		}
 
+		tx, err := db.BeginTx(c.Request.Context(), nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при регистрации"})
+			return
+		}
+		defer tx.Rollback()
+
 		var id int
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			INSERT INTO users (full_name, email, password_hash, phone, role, clinic_id)
 			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
 			req.FullName, req.Email, string(hash), req.Phone, req.Role, req.ClinicID).Scan(&id)
@@ -78,6 +90,16 @@ func main() {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при регистрации"})
 			return
 		}
+		err = eventbus.Publish(c.Request.Context(), tx, eventbus.UserRegistered,
+			eventbus.User{UserID: id, Role: req.Role, ClinicID: req.ClinicID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при регистрации"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка при регистрации"})
+			return
+		}
 
 		c.JSON(http.StatusCreated, gin.H{"id": id})
 	})
@@ -124,8 +146,8 @@ func main() {
 	})
 
 	// 3) Получить профиль (/me)
-	// Предполагаем, что Gateway уже проверил токен,
-	// и прокинул X-User-ID = <число>.
+	// Gateway проверяет токен и проставляет X-User-ID из него;
+	// присланный клиентом X-User-ID он отбрасывает.
 	r.GET("/me", func(c *gin.Context) {
 		userID := c.GetHeader("X-User-ID")
 		if userID == "" {